@@ -60,6 +60,7 @@ type Conf struct {
 	ShortURLKey      string
 
 	TSDBHost             string                    // OpenTSDB relay and query destination: ny-devtsdb04:4242
+	TSDBRetries          int                       // Number of times to retry transient OpenTSDB query errors
 	GraphiteHost         string                    // Graphite query host: foo.bar.baz
 	LogstashElasticHosts expr.LogstashElasticHosts // CSV Elastic Hosts (All part of the same cluster) that stores logstash documents, i.e http://ny-elastic01:9200
 
@@ -94,13 +95,20 @@ func (c *Conf) PutAuthorized(ip net.IP) bool {
 	return false
 }
 
-// TSDBContext returns an OpenTSDB context limited to
-// c.ResponseLimit. A nil context is returned if TSDBHost is not set.
-func (c *Conf) TSDBContext() opentsdb.Context {
+// TSDBContext returns an OpenTSDB context limited to c.ResponseLimit and
+// retrying transient errors c.TSDBRetries times. Closing cancel, if non nil,
+// stops any pending retry. A nil context is returned if TSDBHost is not set.
+func (c *Conf) TSDBContext(cancel <-chan struct{}) opentsdb.Context {
 	if c.TSDBHost == "" {
 		return nil
 	}
-	return opentsdb.NewLimitContext(c.TSDBHost, c.ResponseLimit)
+	var ctx opentsdb.Context = opentsdb.NewLimitContext(c.TSDBHost, c.ResponseLimit)
+	if c.TSDBRetries > 0 {
+		rc := opentsdb.NewRetryContext(ctx, c.TSDBRetries)
+		rc.Cancel = cancel
+		ctx = rc
+	}
+	return ctx
 }
 
 // GraphiteContext returns a Graphite context. A nil context is returned if
@@ -413,6 +421,15 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 			v += ":4242"
 		}
 		c.TSDBHost = v
+	case "tsdbRetries":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i < 0 {
+			c.errorf("tsdbRetries must be >= 0")
+		}
+		c.TSDBRetries = i
 	case "graphiteHost":
 		c.GraphiteHost = v
 	case "logstashElasticHosts":
@@ -938,6 +955,10 @@ func (c *Conf) findAllDependencies(a *Alert) {
 					name := n.Args[0].(*eparse.StringNode).Text
 					lookup := c.Lookups[name]
 					addIfUnique(&lookup.ConfItem)
+				} else if n.Name == "enrich" && len(n.Args) > 1 {
+					name := n.Args[1].(*eparse.StringNode).Text
+					lookup := c.Lookups[name]
+					addIfUnique(&lookup.ConfItem)
 				} else if n.Name == "alert" && len(n.Args) > 0 {
 					name := n.Args[0].(*eparse.StringNode).Text
 					alert := c.Alerts[name]
@@ -1315,6 +1336,23 @@ func (c *Conf) Funcs() map[string]eparse.Func {
 		}
 		return results, nil
 	}
+	enrichTags := func(args []eparse.Node) (eparse.Tags, error) {
+		t, err := args[0].Tags()
+		if err != nil {
+			return nil, err
+		}
+		name := args[1].(*eparse.StringNode).Text
+		lookup := c.Lookups[name]
+		if lookup == nil {
+			return nil, fmt.Errorf("bad lookup table %v", name)
+		}
+		for _, entry := range lookup.Entries {
+			for k := range entry.Values {
+				t[k] = struct{}{}
+			}
+		}
+		return t, nil
+	}
 	lookupTags := func(args []eparse.Node) (eparse.Tags, error) {
 		name := args[0].(*eparse.StringNode).Text
 		lookup := c.Lookups[name]
@@ -1372,6 +1410,12 @@ func (c *Conf) Funcs() map[string]eparse.Func {
 			Tags:   lookupSeriesTags,
 			F:      lookupSeries,
 		},
+		"enrich": {
+			Args:   []eparse.FuncType{eparse.TypeSeries, eparse.TypeString},
+			Return: eparse.TypeSeries,
+			Tags:   enrichTags,
+			F:      c.enrich,
+		},
 	}
 	merge := func(fs map[string]eparse.Func) {
 		for k, v := range fs {
@@ -1410,6 +1454,31 @@ func (c *Conf) getAlertExpr(name, key string) (*Alert, *expr.Expr, error) {
 	return a, e, nil
 }
 
+// enrich adds the values of every entry in the named lookup table that
+// matches a result's group to that group as extra tags, so later functions
+// can group by them. Tags the group already has are never overwritten, and
+// groups no entry matches are passed through unchanged.
+func (c *Conf) enrich(s *expr.State, T miniprofiler.Timer, series *expr.Results, lookup string) (*expr.Results, error) {
+	l := c.Lookups[lookup]
+	if l == nil {
+		return nil, fmt.Errorf("lookup table not found: %v", lookup)
+	}
+	lookups := l.ToExpr()
+	results := *series
+	results.Results = nil
+	for _, res := range series.Results {
+		r := *res
+		r.Group = res.Group.Copy()
+		for k, v := range lookups.Values(res.Group) {
+			if _, ok := r.Group[k]; !ok {
+				r.Group[k] = v
+			}
+		}
+		results.Results = append(results.Results, &r)
+	}
+	return &results, nil
+}
+
 func (c *Conf) alert(s *expr.State, T miniprofiler.Timer, name, key string) (results *expr.Results, err error) {
 	_, e, err := c.getAlertExpr(name, key)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"testing"
 
+	"bosun.org/cmd/bosun/expr"
 	"bosun.org/opentsdb"
 )
 
@@ -67,6 +68,7 @@ func TestInvalid(t *testing.T) {
 		"number-func-args":     `conf: number-func-args:4:1: at <warn = q("avg:o", ""...>: expr: parse: not enough arguments for q`,
 		"lookup-key-pairs-dup": `conf: lookup-key-pairs-dup:3:1: at <entry b=2,a=1 { }>: duplicate entry`,
 		"crit-warn-unmatching-tags": `conf: crit-warn-unmatching-tags:3:0: at <alert broken {\n	cri...>: crit tags (a,c) and warn tags (c) must be equal`,
+		"undeclared-constant": `conf: undeclared-constant:4:1: at <crit = avg(q("sum:m{...>: expr: unknown function 'threshhold' at position 37`,
 		"depends-no-overlap": `conf: depends-no-overlap:3:0: at <alert broken {\n	dep...>: Depends and crit/warn must share at least one tag.`,
 	}
 	for fname, reason := range names {
@@ -147,3 +149,82 @@ func TestSquelch(t *testing.T) {
 		}
 	}
 }
+
+func TestEnrich(t *testing.T) {
+	c, err := New("enrich", `
+		tsdbHost = localhost:4242
+		lookup teams {
+			entry host=web* {
+				team = frontend
+				tier = 1
+			}
+			entry host=db01 {
+				team = storage
+			}
+			entry host=db*|cache* {
+				tier = 3
+				env = prod
+			}
+		}
+		alert a {
+			crit = max(enrich(q("sum:m{host=*}", "5m", ""), "teams")) > 0
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := &expr.Results{Results: expr.ResultSlice{
+		{Group: opentsdb.TagSet{"host": "web01"}, Value: expr.Series{}},
+		{Group: opentsdb.TagSet{"host": "db01"}, Value: expr.Series{}},
+		{Group: opentsdb.TagSet{"host": "cache01", "env": "dev"}, Value: expr.Series{}},
+		{Group: opentsdb.TagSet{"host": "lb01"}, Value: expr.Series{}},
+	}}
+	res, err := c.enrich(nil, nil, series, "teams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []opentsdb.TagSet{
+		{"host": "web01", "team": "frontend", "tier": "1"},
+		{"host": "db01", "team": "storage", "tier": "3", "env": "prod"},
+		{"host": "cache01", "tier": "3", "env": "dev"},
+		{"host": "lb01"},
+	}
+	if len(res.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(res.Results))
+	}
+	for i, r := range res.Results {
+		if !r.Group.Equal(expected[i]) {
+			t.Errorf("result %d: expected %v, got %v", i, expected[i], r.Group)
+		}
+	}
+	if !series.Results[0].Group.Equal(opentsdb.TagSet{"host": "web01"}) {
+		t.Errorf("input group modified: %v", series.Results[0].Group)
+	}
+	if _, err := c.enrich(nil, nil, series, "missing"); err == nil {
+		t.Error("expected error for unknown lookup table")
+	}
+	tags, err := c.Alerts["a"].Crit.Root.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"host", "team", "tier", "env"} {
+		if _, ok := tags[k]; !ok {
+			t.Errorf("expected tag %q in %v", k, tags)
+		}
+	}
+}
+
+func TestTSDBContextCancel(t *testing.T) {
+	c, err := New("test", "tsdbHost = localhost:4242\ntsdbRetries = 2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel := make(chan struct{})
+	rc, ok := c.TSDBContext(cancel).(*opentsdb.RetryContext)
+	if !ok {
+		t.Fatalf("expected a RetryContext, got %T", c.TSDBContext(cancel))
+	}
+	if rc.Retries != 2 || rc.Cancel != (<-chan struct{})(cancel) {
+		t.Errorf("got retries %d and cancel %v, expected 2 and %v", rc.Retries, rc.Cancel, cancel)
+	}
+}
@@ -42,6 +42,9 @@ const dependencyTestConfig = `
 		warnNotification = lookup("host_base_contact", "main_contact")
 		warn = avg(q("avg:os.cpu{host=*}", "1m", "")) > 50
 	}
+	alert enrichLookups{
+		warn = max(enrich(q("avg:os.cpu{host=*}", "1m", ""), "host_base_contact")) > 50
+	}
 	
 `
 
@@ -62,6 +65,9 @@ func TestConfDependencies(t *testing.T) {
 
 	expected = "default,foo,host_base_contact"
 	assertTemplateSequenceEqual(t, templates, "notificationLookups", expected)
+
+	expected = "host_base_contact"
+	assertTemplateSequenceEqual(t, templates, "enrichLookups", expected)
 }
 
 func assertTemplateSequenceEqual(t *testing.T, templates *AlertTemplateStrings, alert, expected string) {
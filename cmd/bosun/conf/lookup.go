@@ -23,16 +23,9 @@ func (lookup *ExprLookup) Get(key string, tag opentsdb.TagSet) (value string, ok
 		if !ok {
 			continue
 		}
-		match := true
-		for ak, av := range entry.AlertKey.Group() {
-			matches, err := search.Match(av, []string{tag[ak]})
-			if err != nil {
-				return "", false
-			}
-			if len(matches) == 0 {
-				match = false
-				break
-			}
+		match, err := entry.match(tag)
+		if err != nil {
+			return "", false
 		}
 		if !match {
 			continue
@@ -41,3 +34,33 @@ func (lookup *ExprLookup) Get(key string, tag opentsdb.TagSet) (value string, ok
 	}
 	return "", false
 }
+
+// Values returns every key/value of the entries that match tag. When more
+// than one entry sets a key, the first one wins, as with Get.
+func (lookup *ExprLookup) Values(tag opentsdb.TagSet) map[string]string {
+	values := make(map[string]string)
+	for _, entry := range lookup.Entries {
+		if match, err := entry.match(tag); err != nil || !match {
+			continue
+		}
+		for k, v := range entry.Values {
+			if _, ok := values[k]; !ok {
+				values[k] = v
+			}
+		}
+	}
+	return values
+}
+
+func (entry *ExprEntry) match(tag opentsdb.TagSet) (bool, error) {
+	for ak, av := range entry.AlertKey.Group() {
+		matches, err := search.Match(av, []string{tag[ak]})
+		if err != nil {
+			return false, err
+		}
+		if len(matches) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
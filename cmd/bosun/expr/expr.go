@@ -1,13 +1,19 @@
 package expr // import "bosun.org/cmd/bosun/expr"
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
 	"math"
+	"math/rand"
 	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
+	"strings"
 	"time"
+	"unicode"
 
 	"bosun.org/_third_party/github.com/MiniProfiler/go/miniprofiler"
 	"bosun.org/_third_party/github.com/olivere/elastic"
@@ -40,6 +46,40 @@ type State struct {
 	logstashHosts   LogstashElasticHosts
 
 	History AlertStatusProvider
+
+	// walked memoizes the results of sub-expressions by their structure.
+	walked map[string]*Results
+
+	stats EvalStats
+
+	// mapValue is the value returned by v() while map() evaluates its
+	// expression.
+	mapValue float64
+
+	// call is the text of the function call being evaluated.
+	call string
+	// prior and next are the persisted values from the previous execution and
+	// for the next one.
+	prior, next PersistedState
+}
+
+// PersistedState holds values that functions such as persisted_avg carry from
+// one execution of an expression to the next, keyed by the function call and
+// group.
+type PersistedState map[string]float64
+
+// EvalStats describes the work done by a single evaluation of an expression.
+type EvalStats struct {
+	// Queries is the number of OpenTSDB and Graphite queries issued.
+	Queries int
+	// Points is the total number of data points those queries returned.
+	Points int
+	// Duration is the time spent evaluating the expression.
+	Duration time.Duration
+	// Warnings describes problems that did not fail the evaluation, such as
+	// the operands of a binary operator being grouped by disjoint tag keys,
+	// which usually means two queries that should align do not.
+	Warnings []string
 }
 
 // Alert Status Provider is used to provide information about alert results.
@@ -52,6 +92,34 @@ var ErrUnknownOp = fmt.Errorf("expr: unknown op type")
 
 type Expr struct {
 	*parse.Tree
+
+	// ErrOnEmpty causes a query returning no groups to fail the expression
+	// instead of yielding an empty result set.
+	ErrOnEmpty bool
+
+	// Vars are substituted for $name or ${name} in query strings when the
+	// expression is executed, so a query such as "sum:cpu{host=$host}" can
+	// be reused. A query naming a variable not in Vars is an error.
+	Vars map[string]string
+
+	// Consts are the values of the named constants, such as threshold in
+	// avg(q(..)) > threshold, used in the expression. Only expressions
+	// created by NewConsts may use constants, and executing one using a
+	// constant not in Consts is an error.
+	Consts map[string]float64
+
+	// Trace, if set, receives a line for each node evaluated with the node's
+	// position, text and results.
+	Trace *log.Logger
+
+	// Jitter, if positive, moves the evaluation time of each Execute back by
+	// a random offset in [0, Jitter) to spread out queries from expressions
+	// run at the same instant.
+	Jitter time.Duration
+	// Rand is the source of the jitter offsets. It may be set to a seeded
+	// source for reproducible offsets, but must then not be shared between
+	// concurrent Executes. If nil, the math/rand global source is used.
+	Rand *rand.Rand
 }
 
 func (e *Expr) MarshalJSON() ([]byte, error) {
@@ -59,25 +127,116 @@ func (e *Expr) MarshalJSON() ([]byte, error) {
 }
 
 func New(expr string, funcs ...map[string]parse.Func) (*Expr, error) {
+	return NewConsts(expr, nil, funcs...)
+}
+
+// NewConsts is like New, but allows the expression to use the names in consts
+// as named constants, and sets its Consts to consts. Any other bare name is
+// an unknown function.
+func NewConsts(expr string, consts map[string]float64, funcs ...map[string]parse.Func) (*Expr, error) {
 	funcs = append(funcs, builtins)
-	t, err := parse.Parse(expr, funcs...)
-	if err != nil {
+	t := parse.New()
+	t.Consts = make(map[string]bool)
+	for name := range consts {
+		t.Consts[name] = true
+	}
+	if err := t.Parse(expr, funcs...); err != nil {
 		return nil, err
 	}
 	e := &Expr{
-		Tree: t,
+		Tree:   t,
+		Consts: consts,
 	}
 	return e, nil
 }
 
+// Fragments is a registry of named sub-expressions. An expression created by
+// its New method may refer to a fragment as @name, and each reference is
+// replaced by the parenthesized fragment before parsing. Fragments may refer
+// to other fragments, but not to themselves.
+type Fragments map[string]string
+
+// New is like the package New, but first expands the fragment references in
+// expr. Referring to a fragment not in f is an error.
+func (f Fragments) New(expr string, funcs ...map[string]parse.Func) (*Expr, error) {
+	expr, err := f.expand(expr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return New(expr, funcs...)
+}
+
+// expand replaces the fragment references outside of strings in s. stack
+// holds the fragments being expanded, to detect cycles.
+func (f Fragments) expand(s string, stack []string) (string, error) {
+	var b bytes.Buffer
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c != '@' || quoted {
+			b.WriteByte(c)
+			continue
+		}
+		j := i + 1
+		for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+			j++
+		}
+		name := s[i+1 : j]
+		frag, ok := f[name]
+		if !ok {
+			return "", fmt.Errorf("expr: undefined fragment @%s", name)
+		}
+		for _, n := range stack {
+			if n == name {
+				return "", fmt.Errorf("expr: fragment @%s refers to itself", name)
+			}
+		}
+		frag, err := f.expand(frag, append(stack, name))
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("(" + frag + ")")
+		i = j - 1
+	}
+	return b.String(), nil
+}
+
 // Execute applies a parse expression to the specified OpenTSDB context, and
 // returns one result per group. T may be nil to ignore timings.
 func (e *Expr) Execute(c opentsdb.Context, g graphite.Context, l LogstashElasticHosts, cache *cache.Cache, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, squelched func(tags opentsdb.TagSet) bool, history AlertStatusProvider) (r *Results, queries []opentsdb.Request, err error) {
+	r, queries, _, err = e.ExecuteWithStats(c, g, l, cache, T, now, autods, unjoinedOk, search, squelched, history)
+	return
+}
+
+// ExecuteWithStats is like Execute, but also returns statistics about the
+// evaluation.
+func (e *Expr) ExecuteWithStats(c opentsdb.Context, g graphite.Context, l LogstashElasticHosts, cache *cache.Cache, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, squelched func(tags opentsdb.TagSet) bool, history AlertStatusProvider) (r *Results, queries []opentsdb.Request, stats EvalStats, err error) {
+	s := e.newState(c, g, l, cache, now, autods, unjoinedOk, search, squelched, history)
+	r, queries, err = e.ExecuteState(s, T)
+	return r, queries, s.stats, err
+}
+
+// ExecuteWithPrior is like Execute, but also makes prior, the state returned
+// by the previous execution, available to functions such as persisted_avg, and
+// returns the state to pass to the next one.
+func (e *Expr) ExecuteWithPrior(prior PersistedState, c opentsdb.Context, g graphite.Context, l LogstashElasticHosts, cache *cache.Cache, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, squelched func(tags opentsdb.TagSet) bool, history AlertStatusProvider) (r *Results, queries []opentsdb.Request, next PersistedState, err error) {
+	s := e.newState(c, g, l, cache, now, autods, unjoinedOk, search, squelched, history)
+	s.prior = prior
+	s.next = make(PersistedState)
+	r, queries, err = e.ExecuteState(s, T)
+	return r, queries, s.next, err
+}
+
+func (e *Expr) newState(c opentsdb.Context, g graphite.Context, l LogstashElasticHosts, cache *cache.Cache, now time.Time, autods int, unjoinedOk bool, search *search.Search, squelched func(tags opentsdb.TagSet) bool, history AlertStatusProvider) *State {
 	if squelched == nil {
 		squelched = func(tags opentsdb.TagSet) bool {
 			return false
 		}
 	}
+	now = now.Add(-e.jitter())
 	s := &State{
 		Expr:            e,
 		cache:           cache,
@@ -91,7 +250,26 @@ func (e *Expr) Execute(c opentsdb.Context, g graphite.Context, l LogstashElastic
 		squelched:       squelched,
 		History:         history,
 	}
-	return e.ExecuteState(s, T)
+	return s
+}
+
+// ExecuteHosts is like Execute, but queries the OpenTSDB hosts according to
+// mode: either failing over from one host to the next on error, or fanning out
+// to all of them and merging the responses.
+func (e *Expr) ExecuteHosts(hosts []string, mode opentsdb.HostMode, g graphite.Context, l LogstashElasticHosts, cache *cache.Cache, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, squelched func(tags opentsdb.TagSet) bool, history AlertStatusProvider) (r *Results, queries []opentsdb.Request, err error) {
+	c := opentsdb.NewMultiContext(mode, hosts...)
+	return e.Execute(c, g, l, cache, T, now, autods, unjoinedOk, search, squelched, history)
+}
+
+// jitter returns a random offset in [0, e.Jitter), or 0 if Jitter is not set.
+func (e *Expr) jitter() time.Duration {
+	if e.Jitter <= 0 {
+		return 0
+	}
+	if e.Rand != nil {
+		return time.Duration(e.Rand.Int63n(int64(e.Jitter)))
+	}
+	return time.Duration(rand.Int63n(int64(e.Jitter)))
 }
 
 func (e *Expr) ExecuteState(s *State, T miniprofiler.Timer) (r *Results, queries []opentsdb.Request, err error) {
@@ -99,6 +277,8 @@ func (e *Expr) ExecuteState(s *State, T miniprofiler.Timer) (r *Results, queries
 	if T == nil {
 		T = new(miniprofiler.Profile)
 	}
+	start := time.Now()
+	defer func() { s.stats.Duration = time.Since(start) }()
 	T.Step("expr execute", func(T miniprofiler.Timer) {
 		r = s.walk(e.Tree.Root, T)
 	})
@@ -106,6 +286,31 @@ func (e *Expr) ExecuteState(s *State, T miniprofiler.Timer) (r *Results, queries
 	return
 }
 
+// checkEmpty returns an error naming query if ErrOnEmpty is set and the query
+// returned no groups. Groups that are later squelched still count as data.
+func (e *State) checkEmpty(fname, query string, groups int) error {
+	if e.ErrOnEmpty && groups == 0 {
+		return fmt.Errorf("%s: query returned no data: %s", fname, query)
+	}
+	return nil
+}
+
+var varRE = regexp.MustCompile(`\$(?:\w+|\{\w+\})`)
+
+// expandVars replaces the variables in query with their values from Vars.
+func (e *State) expandVars(fname, query string) (string, error) {
+	var err error
+	query = varRE.ReplaceAllStringFunc(query, func(s string) string {
+		name := strings.Trim(s[1:], "{}")
+		v, ok := e.Vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("%s: unknown variable %s in query %s", fname, s, query)
+		}
+		return v
+	})
+	return query, err
+}
+
 // errRecover is the handler that turns panics into returns from the top
 // level of Parse.
 func errRecover(errp *error) {
@@ -164,6 +369,26 @@ func (s Series) MarshalJSON() ([]byte, error) {
 	return json.Marshal(r)
 }
 
+// Pair is the value of two series at the same time.
+type Pair struct {
+	A, B float64
+}
+
+// Pairs holds the points of two series aligned on their timestamps, with one
+// entry per time present in both.
+type Pairs map[time.Time]Pair
+
+func (p Pairs) Type() parse.FuncType { return parse.TypePairs }
+func (p Pairs) Value() interface{}   { return p }
+
+func (p Pairs) MarshalJSON() ([]byte, error) {
+	r := make(map[string][2]Scalar, len(p))
+	for k, v := range p {
+		r[fmt.Sprint(k.Unix())] = [2]Scalar{Scalar(v.A), Scalar(v.B)}
+	}
+	return json.Marshal(r)
+}
+
 type SortablePoint struct {
 	T time.Time
 	V float64
@@ -205,6 +430,45 @@ type Results struct {
 
 type ResultSlice []*Result
 
+// Copy returns a deep copy of r, safe for builtins to modify in place.
+func (r *Results) Copy() *Results {
+	c := *r
+	if r.NaNValue != nil {
+		v := *r.NaNValue
+		c.NaNValue = &v
+	}
+	c.Results = make(ResultSlice, len(r.Results))
+	for i, res := range r.Results {
+		c.Results[i] = res.Copy()
+	}
+	return &c
+}
+
+// Tag returns the value of the tag key in r's group, or "" if the group does
+// not have that tag.
+func (r *Result) Tag(key string) string {
+	return r.Group[key]
+}
+
+// Copy returns a deep copy of r.
+func (r *Result) Copy() *Result {
+	c := &Result{
+		Computations: append(Computations(nil), r.Computations...),
+		Value:        r.Value,
+	}
+	if r.Group != nil {
+		c.Group = r.Group.Copy()
+	}
+	if s, ok := r.Value.(Series); ok {
+		ns := make(Series, len(s))
+		for k, v := range s {
+			ns[k] = v
+		}
+		c.Value = ns
+	}
+	return c
+}
+
 func (r *Results) NaN() Number {
 	if r.NaNValue != nil {
 		return Number(*r.NaNValue)
@@ -212,6 +476,17 @@ func (r *Results) NaN() Number {
 	return Number(math.NaN())
 }
 
+// tagKeys returns the tag keys used by any of the groups of r.
+func (r *Results) tagKeys() parse.Tags {
+	t := make(parse.Tags)
+	for _, res := range r.Results {
+		for k := range res.Group {
+			t[k] = struct{}{}
+		}
+	}
+	return t
+}
+
 func (r ResultSlice) DescByValue() ResultSlice {
 	for _, v := range r {
 		if _, ok := v.Value.(Number); !ok {
@@ -234,6 +509,21 @@ func (r ResultSlice) Filter(filter opentsdb.TagSet) ResultSlice {
 	return output
 }
 
+// CanonicalJSON encodes r as JSON with the results ordered by group, so equal
+// result sets always encode to the same bytes regardless of evaluation order.
+func (r ResultSlice) CanonicalJSON() ([]byte, error) {
+	c := make(ResultSlice, len(r))
+	copy(c, r)
+	sort.Stable(resultsByGroup(c))
+	return json.Marshal(c)
+}
+
+type resultsByGroup ResultSlice
+
+func (r resultsByGroup) Len() int           { return len(r) }
+func (r resultsByGroup) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r resultsByGroup) Less(i, j int) bool { return r[i].Group.String() < r[j].Group.String() }
+
 func (r ResultSlice) Len() int           { return len(r) }
 func (r ResultSlice) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
 func (r ResultSlice) Less(i, j int) bool { return r[i].Value.(Number) > r[j].Value.(Number) }
@@ -292,17 +582,18 @@ func (e *State) union(a, b *Results, expression string) []*Union {
 				A: ra.Value,
 				B: rb.Value,
 			}
-			if ra.Group.Equal(rb.Group) || len(ra.Group) == 0 || len(rb.Group) == 0 {
-				g := ra.Group
-				if len(ra.Group) == 0 {
-					g = rb.Group
-				}
-				u.Group = g
-			} else if ra.Group.Subset(rb.Group) {
+			// An ungrouped operand, such as a scalar, is broadcast to
+			// every group of the other side.
+			switch {
+			case len(ra.Group) == 0:
+				u.Group = rb.Group
+			case len(rb.Group) == 0:
 				u.Group = ra.Group
-			} else if rb.Group.Subset(ra.Group) {
+			case ra.Group.Equal(rb.Group), ra.Group.Subset(rb.Group):
+				u.Group = ra.Group
+			case rb.Group.Subset(ra.Group):
 				u.Group = rb.Group
-			} else {
+			default:
 				continue
 			}
 			delete(am, ra)
@@ -341,23 +632,62 @@ func (e *State) union(a, b *Results, expression string) []*Union {
 	return us
 }
 
+// walk evaluates node. Identical sub-expressions are only evaluated once per
+// execution; later walks receive a copy of the first result.
 func (e *State) walk(node parse.Node, T miniprofiler.Timer) *Results {
+	if n, ok := node.(*parse.NumberNode); ok {
+		return wrap(n.Float64)
+	}
+	key := node.StringAST()
+	if res, ok := e.walked[key]; ok {
+		if e.Trace != nil {
+			e.trace(node, res, " (memoized)")
+		}
+		return res.Copy()
+	}
 	var res *Results
 	switch node := node.(type) {
-	case *parse.NumberNode:
-		res = wrap(node.Float64)
 	case *parse.BinaryNode:
 		res = e.walkBinary(node, T)
 	case *parse.UnaryNode:
 		res = e.walkUnary(node, T)
 	case *parse.FuncNode:
 		res = e.walkFunc(node, T)
+	case *parse.ConstNode:
+		v, ok := e.Consts[node.Name]
+		if !ok {
+			panic(fmt.Errorf("expr: undefined constant %s", node.Name))
+		}
+		res = wrap(v)
 	default:
 		panic(fmt.Errorf("expr: unknown node type"))
 	}
+	if e.walked == nil {
+		e.walked = make(map[string]*Results)
+	}
+	e.walked[key] = res.Copy()
+	if e.Trace != nil {
+		e.trace(node, res, "")
+	}
 	return res
 }
 
+// trace logs the results of node to e.Trace.
+func (e *State) trace(node parse.Node, res *Results, note string) {
+	var vals []string
+	for _, r := range res.Results {
+		var v string
+		switch t := r.Value.(type) {
+		case Series:
+			v = fmt.Sprintf("series(%d points)", len(t))
+		default:
+			v = fmt.Sprint(t.Value())
+		}
+		vals = append(vals, fmt.Sprintf("%s=%s", r.Group, v))
+	}
+	e.Trace.Printf("%d: %s%s -> [%s]", node.Position(), node, note, strings.Join(vals, " "))
+}
+
 func (e *State) walkBinary(node *parse.BinaryNode, T miniprofiler.Timer) *Results {
 	ar := e.walk(node.Args[0], T)
 	br := e.walk(node.Args[1], T)
@@ -365,6 +695,9 @@ func (e *State) walkBinary(node *parse.BinaryNode, T miniprofiler.Timer) *Result
 		IgnoreUnjoined:      ar.IgnoreUnjoined || br.IgnoreUnjoined,
 		IgnoreOtherUnjoined: ar.IgnoreOtherUnjoined || br.IgnoreOtherUnjoined,
 	}
+	if ak, bk := ar.tagKeys(), br.tagKeys(); len(ak) > 0 && len(bk) > 0 && len(ak.Intersection(bk)) == 0 {
+		e.stats.Warnings = append(e.stats.Warnings, fmt.Sprintf("%s: operands have disjoint tag keys (%s) and (%s)", node, ak, bk))
+	}
 	T.Step("walkBinary: "+node.OpStr, func(T miniprofiler.Timer) {
 		u := e.union(ar, br, node.String())
 		for _, v := range u {
@@ -373,65 +706,62 @@ func (e *State) walkBinary(node *parse.BinaryNode, T miniprofiler.Timer) *Result
 				Group:        v.Group,
 				Computations: v.Computations,
 			}
-			an, aok := v.A.(Scalar)
-			bn, bok := v.B.(Scalar)
-			if (aok && math.IsNaN(float64(an))) || (bok && math.IsNaN(float64(bn))) {
-				value = Scalar(math.NaN())
-			} else {
-				switch at := v.A.(type) {
+			// A scalar operand applies to every group of the other
+			// operand, and the result keeps that operand's type even
+			// when the scalar is NaN.
+			switch at := v.A.(type) {
+			case Scalar:
+				switch bt := v.B.(type) {
 				case Scalar:
-					switch bt := v.B.(type) {
-					case Scalar:
-						n := Scalar(operate(node.OpStr, float64(at), float64(bt)))
-						r.AddComputation(node.String(), Number(n))
-						value = n
-					case Number:
-						n := Number(operate(node.OpStr, float64(at), float64(bt)))
-						r.AddComputation(node.String(), n)
-						value = n
-					case Series:
-						s := make(Series)
-						for k, v := range bt {
-							s[k] = operate(node.OpStr, float64(at), float64(v))
-						}
-						value = s
-					default:
-						panic(ErrUnknownOp)
-					}
+					n := Scalar(operate(node.OpStr, float64(at), float64(bt)))
+					r.AddComputation(node.String(), Number(n))
+					value = n
 				case Number:
-					switch bt := v.B.(type) {
-					case Scalar:
-						n := Number(operate(node.OpStr, float64(at), float64(bt)))
-						r.AddComputation(node.String(), Number(n))
-						value = n
-					case Number:
-						n := Number(operate(node.OpStr, float64(at), float64(bt)))
-						r.AddComputation(node.String(), n)
-						value = n
-					case Series:
-						s := make(Series)
-						for k, v := range bt {
-							s[k] = operate(node.OpStr, float64(at), float64(v))
-						}
-						value = s
-					default:
-						panic(ErrUnknownOp)
+					n := Number(operate(node.OpStr, float64(at), float64(bt)))
+					r.AddComputation(node.String(), n)
+					value = n
+				case Series:
+					s := make(Series)
+					for k, v := range bt {
+						s[k] = operate(node.OpStr, float64(at), float64(v))
 					}
+					value = s
+				default:
+					panic(ErrUnknownOp)
+				}
+			case Number:
+				switch bt := v.B.(type) {
+				case Scalar:
+					n := Number(operate(node.OpStr, float64(at), float64(bt)))
+					r.AddComputation(node.String(), Number(n))
+					value = n
+				case Number:
+					n := Number(operate(node.OpStr, float64(at), float64(bt)))
+					r.AddComputation(node.String(), n)
+					value = n
 				case Series:
-					switch bt := v.B.(type) {
-					case Number, Scalar:
-						bv := reflect.ValueOf(bt).Float()
-						s := make(Series)
-						for k, v := range at {
-							s[k] = operate(node.OpStr, float64(v), bv)
-						}
-						value = s
-					default:
-						panic(ErrUnknownOp)
+					s := make(Series)
+					for k, v := range bt {
+						s[k] = operate(node.OpStr, float64(at), float64(v))
 					}
+					value = s
 				default:
 					panic(ErrUnknownOp)
 				}
+			case Series:
+				switch bt := v.B.(type) {
+				case Number, Scalar:
+					bv := reflect.ValueOf(bt).Float()
+					s := make(Series)
+					for k, v := range at {
+						s[k] = operate(node.OpStr, float64(v), bv)
+					}
+					value = s
+				default:
+					panic(ErrUnknownOp)
+				}
+			default:
+				panic(ErrUnknownOp)
 			}
 			r.Value = value
 			res.Results = append(res.Results, &r)
@@ -550,29 +880,51 @@ func uoperate(op string, a float64) (r float64) {
 	return
 }
 
+// listValue converts a list literal to a slice of type typ, which is
+// []float64 or []string.
+func listValue(l *parse.ListNode, typ reflect.Type) reflect.Value {
+	v := reflect.MakeSlice(typ, 0, len(l.Items))
+	for _, n := range l.Items {
+		var item interface{}
+		switch n := n.(type) {
+		case *parse.NumberNode:
+			item = n.Float64
+		case *parse.StringNode:
+			item = n.Text
+		}
+		iv := reflect.ValueOf(item)
+		if iv.Type() != typ.Elem() {
+			panic(fmt.Errorf("expr: bad list item %s, expected %s", n, typ.Elem()))
+		}
+		v = reflect.Append(v, iv)
+	}
+	return v
+}
+
 func (e *State) walkFunc(node *parse.FuncNode, T miniprofiler.Timer) *Results {
 	var res *Results
 	T.Step("func: "+node.Name, func(T miniprofiler.Timer) {
 		var in []reflect.Value
-		for _, a := range node.Args {
+		f := reflect.ValueOf(node.F.F)
+		for i, a := range node.Args {
 			var v interface{}
 			switch t := a.(type) {
 			case *parse.StringNode:
 				v = t.Text
 			case *parse.NumberNode:
 				v = t.Float64
-			case *parse.FuncNode:
-				v = extractScalar(e.walkFunc(t, T))
-			case *parse.UnaryNode:
-				v = extractScalar(e.walkUnary(t, T))
-			case *parse.BinaryNode:
-				v = extractScalar(e.walkBinary(t, T))
+			case *parse.ListNode:
+				// Skip the State and Timer parameters.
+				in = append(in, listValue(t, f.Type().In(i+2)))
+				continue
+			case *parse.FuncNode, *parse.UnaryNode, *parse.BinaryNode, *parse.ConstNode:
+				v = extractScalar(e.walk(t, T))
 			default:
 				panic(fmt.Errorf("expr: unknown func arg type"))
 			}
 			in = append(in, reflect.ValueOf(v))
 		}
-		f := reflect.ValueOf(node.F.F)
+		e.call = node.StringAST()
 		fr := f.Call(append([]reflect.Value{reflect.ValueOf(e), reflect.ValueOf(T)}, in...))
 		res = fr[0].Interface().(*Results)
 		if len(fr) > 1 && !fr[1].IsNil() {
@@ -1,8 +1,21 @@
 package expr
 
 import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"bosun.org/_third_party/github.com/MiniProfiler/go/miniprofiler"
+	"bosun.org/cmd/bosun/cache"
+	"bosun.org/cmd/bosun/expr/parse"
+	"bosun.org/opentsdb"
 )
 
 func TestExprSimple(t *testing.T) {
@@ -31,6 +44,10 @@ func TestExprSimple(t *testing.T) {
 		{"1>=0", 1},
 		{"1>=1", 1},
 		{"1>=2", 0},
+		{"10 < 15 < 20", 1},
+		{"10 < 25 < 20", 0},
+		{"20 > 15 >= 15", 1},
+		{"3 < 2 < 1", 0},
 		{"-1 > 0", 0},
 		{"-1 < 0", 1},
 	}
@@ -89,6 +106,440 @@ func TestExprParse(t *testing.T) {
 	}
 }
 
+func TestExprList(t *testing.T) {
+	funcs := map[string]parse.Func{
+		"sumlist": {
+			Args:   []parse.FuncType{parse.TypeList},
+			Return: parse.TypeScalar,
+			F: func(e *State, T miniprofiler.Timer, l []float64) (*Results, error) {
+				var s float64
+				for _, v := range l {
+					s += v
+				}
+				return wrap(s), nil
+			},
+		},
+		"lenlist": {
+			Args:   []parse.FuncType{parse.TypeList},
+			Return: parse.TypeScalar,
+			F: func(e *State, T miniprofiler.Timer, l []string) (*Results, error) {
+				return wrap(float64(len(l))), nil
+			},
+		},
+	}
+	var exprTests = []struct {
+		input  string
+		output Scalar
+		err    bool
+	}{
+		{"sumlist([1, 2, 3])", 6, false},
+		{"sumlist([])", 0, false},
+		{`lenlist(["a", "b"])`, 2, false},
+		{`lenlist([])`, 0, false},
+		{`sumlist(["a"])`, 0, true},
+	}
+	for _, et := range exprTests {
+		e, err := New(et.input, funcs)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(nil, nil, nil, nil, nil, time.Now(), 0, false, nil, nil, nil)
+		if et.err {
+			if err == nil {
+				t.Errorf("%v: expected error", et.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if r.Results[0].Value != et.output {
+			t.Errorf("%v: expected %v, got %v", et.input, et.output, r.Results[0].Value)
+		}
+	}
+}
+
+func TestExprConsts(t *testing.T) {
+	e, err := NewConsts("threshold * 2 + offset > 10", map[string]float64{"threshold": 0, "offset": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		consts map[string]float64
+		output Scalar
+	}{
+		{map[string]float64{"threshold": 5, "offset": 1}, 1},
+		{map[string]float64{"threshold": 4, "offset": 1}, 0},
+		{map[string]float64{"threshold": 4, "offset": 3, "unused": 0}, 1},
+	} {
+		e.Consts = test.consts
+		r, _, err := e.Execute(nil, nil, nil, nil, nil, time.Now(), 0, false, nil, nil, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if r.Results[0].Value != test.output {
+			t.Errorf("%v: expected %v, got %v", test.consts, test.output, r.Results[0].Value)
+		}
+	}
+	e.Consts = map[string]float64{"threshold": 5}
+	_, _, err = e.Execute(nil, nil, nil, nil, nil, time.Now(), 0, false, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "undefined constant offset") {
+		t.Errorf("expected undefined constant error, got %v", err)
+	}
+	if _, err := New("threshold * 2 > 10"); err == nil || err.Error() != "expr: unknown function 'threshold' at position 1" {
+		t.Errorf("expected undeclared constant to be an unknown function, got %v", err)
+	}
+}
+
+func TestFragments(t *testing.T) {
+	f := Fragments{
+		"cpu":   `avg(q("sum:cpu{host=*}", "5m", ""))`,
+		"hot":   "@cpu > 90",
+		"sum":   "1 + 2",
+		"loop":  "@loop2",
+		"loop2": "1 + @loop",
+	}
+	tests := []struct {
+		input, output string
+		err           string
+	}{
+		{"@hot && @cpu < 100", `(avg(q("sum:cpu{host=*}", "5m", "")) > 90) && avg(q("sum:cpu{host=*}", "5m", "")) < 100`, ""},
+		{"@sum * 3", "(1 + 2) * 3", ""},
+		{`avg(q("sum:m{host=@cpu}", "5m", ""))`, `avg(q("sum:m{host=@cpu}", "5m", ""))`, ""},
+		{"@missing + 1", "", "undefined fragment @missing"},
+		{"@loop", "", "fragment @loop refers to itself"},
+	}
+	for _, test := range tests {
+		e, err := f.New(test.input, TSDB)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error containing %q, got %v", test.input, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		want, err := New(test.output, TSDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.Root.StringAST(); got != want.Root.StringAST() {
+			t.Errorf("%s: expected %s, got %s", test.input, want.Root.StringAST(), got)
+		}
+	}
+	e, err := f.New("@sum * 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := e.Execute(nil, nil, nil, nil, nil, time.Now(), 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := r.Results[0].Value; v != Scalar(9) {
+		t.Errorf("expected 9, got %v", v)
+	}
+}
+
+func TestExprMemoize(t *testing.T) {
+	calls := 0
+	funcs := map[string]parse.Func{
+		"counter": {
+			Args:   []parse.FuncType{},
+			Return: parse.TypeScalar,
+			F: func(e *State, T miniprofiler.Timer) (*Results, error) {
+				calls++
+				return wrap(2), nil
+			},
+		},
+	}
+	var exprTests = []struct {
+		input  string
+		output Scalar
+		calls  int
+	}{
+		{"counter() + counter()", 4, 1},
+		{"counter()*3 + (counter() * 3)", 12, 1},
+		{"-counter() + -counter() * -1", 0, 1},
+		{"1 < counter() < 3", 1, 1},
+		// Equal strings but different trees must not share a result.
+		{"1 + 2 * 3 + (1 + 2) * 3", 16, 0},
+	}
+	for _, et := range exprTests {
+		calls = 0
+		e, err := New(et.input, funcs)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(nil, nil, nil, nil, nil, time.Now(), 0, false, nil, nil, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if r.Results[0].Value != et.output {
+			t.Errorf("%v: expected %v, got %v", et.input, et.output, r.Results[0].Value)
+		}
+		if calls != et.calls {
+			t.Errorf("%v: expected %v calls, got %v", et.input, et.calls, calls)
+		}
+	}
+}
+
+func TestExprMemoizeCopies(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		// dropna and avg modify their argument in place, which must not
+		// leak into the memoized copy used by the second avg.
+		{expr: `avg(dropna(q("sum:m{host=*}", "1h", ""))) + avg(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": 4}},
+		{expr: `sum(q("sum:m{host=*}", "1h", "") * 2) + sum(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": 18}},
+	})
+	if len(c.requests) != 2 {
+		t.Errorf("expected 2 queries, got %v", len(c.requests))
+	}
+}
+
+func TestExprJitter(t *testing.T) {
+	const jitter = 30 * time.Second
+	ends := func(seed int64) []int64 {
+		c := &testContext{}
+		e, err := New(`avg(q("sum:m", "1h", ""))`, TSDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Jitter = jitter
+		e.Rand = rand.New(rand.NewSource(seed))
+		var ends []int64
+		for i := 0; i < 5; i++ {
+			if _, _, err := e.Execute(c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			r := c.requests[len(c.requests)-1]
+			end := r.End.(int64)
+			// End is truncated to the second, so it may land on the bound.
+			if d := testNow.Unix() - end; d < 0 || d > int64(jitter.Seconds()) {
+				t.Errorf("query end %v outside of jitter bound %v", end, jitter)
+			}
+			if start := r.Start.(int64); end-start != 3600 {
+				t.Errorf("expected a 1h query range, got %vs", end-start)
+			}
+			ends = append(ends, end)
+		}
+		return ends
+	}
+	a, b := ends(1), ends(1)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("expected the same offsets for the same seed, got %v and %v", a, b)
+	}
+	if reflect.DeepEqual(a, ends(2)) {
+		t.Errorf("expected different offsets for a different seed, got %v", a)
+	}
+}
+
+func TestExecuteWithStats(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3),
+			response("host=b", 60, 4, 5),
+		},
+	}}
+	e, err := New(`avg(q("sum:m{host=*}", "1h", "")) + max(q("sum:m{host=*}", "10m", "")) + avg(q("sum:m{host=*}", "1h", ""))`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, stats, err := e.ExecuteWithStats(c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The repeated query is only evaluated once.
+	if stats.Queries != 2 {
+		t.Errorf("expected 2 queries, got %v", stats.Queries)
+	}
+	if stats.Points != 10 {
+		t.Errorf("expected 10 points, got %v", stats.Points)
+	}
+	if stats.Duration <= 0 {
+		t.Errorf("expected a positive duration, got %v", stats.Duration)
+	}
+
+	// A query served from the cache is not issued again, so is not counted.
+	qc := cache.New(0)
+	e, err = New(`avg(q("sum:m{host=*}", "1h", ""))`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int{1, 0} {
+		_, _, stats, err := e.ExecuteWithStats(c, nil, nil, qc, nil, testNow, 0, false, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Queries != expected {
+			t.Errorf("%d: expected %v queries, got %v", i, expected, stats.Queries)
+		}
+		if points := 5 * expected; stats.Points != points {
+			t.Errorf("%d: expected %v points, got %v", i, points, stats.Points)
+		}
+	}
+}
+
+func TestDisjointTagKeysWarning(t *testing.T) {
+	// The test context ignores tag filters, so the responses decide which
+	// tag keys each side ends up grouped by.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"a": {
+			response("host=x,dc=ny", 60, 1),
+		},
+		"b": {
+			response("host=x", 60, 2),
+		},
+		"c": {
+			response("app=y", 60, 3),
+		},
+	}}
+	tests := []struct {
+		expr     string
+		warnings []string
+	}{
+		{`avg(q("sum:a{host=*}", "1h", "")) + avg(q("sum:b{host=*}", "1h", ""))`, nil},
+		{`avg(q("sum:a{host=*}", "1h", "")) + 1`, nil},
+		{`avg(q("sum:a{host=*}", "1h", "")) + avg(q("sum:c{host=*}", "1h", ""))`, []string{
+			`avg(q("sum:a{host=*}", "1h", "")) + avg(q("sum:c{host=*}", "1h", "")): operands have disjoint tag keys (dc,host) and (app)`,
+		}},
+	}
+	for _, test := range tests {
+		e, err := New(test.expr, TSDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, stats, err := e.ExecuteWithStats(c, nil, nil, cache.New(0), nil, testNow, 0, true, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats.Warnings, test.warnings) {
+			t.Errorf("%s: expected warnings %q, got %q", test.expr, test.warnings, stats.Warnings)
+		}
+	}
+}
+
+func TestExprTrace(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 3),
+		},
+	}}
+	e, err := New(`avg(q("sum:m{host=*}", "1h", "")) * 2 + avg(q("sum:m{host=*}", "1h", ""))`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	e.Trace = log.New(&buf, "", 0)
+	if _, _, err := e.Execute(c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`4: q("sum:m{host=*}", "1h", "") -> [{host=a}=series(2 points)]`,
+		`0: avg(q("sum:m{host=*}", "1h", "")) -> [{host=a}=2]`,
+		`34: avg(q("sum:m{host=*}", "1h", "")) * 2 -> [{host=a}=4]`,
+		`40: avg(q("sum:m{host=*}", "1h", "")) (memoized) -> [{host=a}=2]`,
+		`38: avg(q("sum:m{host=*}", "1h", "")) * 2 + avg(q("sum:m{host=*}", "1h", "")) -> [{host=a}=6]`,
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected trace:\n%s", buf.String())
+	}
+}
+
+func TestResultTag(t *testing.T) {
+	r := &Result{Group: opentsdb.TagSet{"host": "ny-web01", "dc": "ny"}}
+	for key, want := range map[string]string{"host": "ny-web01", "dc": "ny", "env": ""} {
+		if got := r.Tag(key); got != want {
+			t.Errorf("%s: expected %q, got %q", key, want, got)
+		}
+	}
+	if got := new(Result).Tag("host"); got != "" {
+		t.Errorf("ungrouped result: expected no tag, got %q", got)
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	var r ResultSlice
+	for i := 0; i < 20; i++ {
+		res := &Result{
+			Value: Series{time.Unix(int64(i), 0).UTC(): 1, time.Unix(60, 0).UTC(): float64(i)},
+			Group: opentsdb.TagSet{"host": fmt.Sprintf("h%02d", i), "dc": "ny"},
+		}
+		res.AddComputation("x", Number(i))
+		r = append(r, res)
+	}
+	want, err := r.CanonicalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		s := make(ResultSlice, len(r))
+		for j, k := range rnd.Perm(len(r)) {
+			s[j] = r[k]
+		}
+		got, err := s.CanonicalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("permutation %d encoded differently:\n%s\n%s", i, got, want)
+		}
+	}
+	got, err := ResultSlice{
+		{Value: Number(2), Group: opentsdb.TagSet{"host": "b"}},
+		{Value: Number(1), Group: opentsdb.TagSet{"host": "a", "dc": "ny"}},
+	}.CanonicalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const exp = `[{"Computations":null,"Value":1,"Group":{"dc":"ny","host":"a"}},{"Computations":null,"Value":2,"Group":{"host":"b"}}]`
+	if string(got) != exp {
+		t.Errorf("got %s, expected %s", got, exp)
+	}
+}
+
+func TestExecuteHosts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"%d":2}}]`, testNow.Unix()-60)
+	}))
+	defer ts.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	hosts := []string{
+		strings.TrimPrefix(down.URL, "http://"),
+		strings.TrimPrefix(ts.URL, "http://"),
+	}
+	e, err := New(`avg(q("sum:m{host=*}", "1h", ""))`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []opentsdb.HostMode{opentsdb.Failover, opentsdb.FanOut} {
+		r, _, err := e.ExecuteHosts(hosts, mode, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil)
+		if err != nil {
+			t.Errorf("mode %v: %v", mode, err)
+			continue
+		}
+		if len(r.Results) != 1 || r.Results[0].Value != Number(2) {
+			t.Errorf("mode %v: unexpected results %v", mode, resultValues(r))
+		}
+	}
+	if _, _, err := e.ExecuteHosts(hosts[:1], opentsdb.Failover, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil); err == nil {
+		t.Error("expected error with all hosts down")
+	}
+}
+
 /*
 const TSDBHost = "ny-devtsdb04:4242"
 
@@ -58,6 +58,18 @@ func tagTranspose(args []parse.Node) (parse.Tags, error) {
 	return tags, nil
 }
 
+func tagBucket(args []parse.Node) (parse.Tags, error) {
+	tags, err := tagFirst(args)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tags["bucket"]; ok {
+		return nil, fmt.Errorf("bucketize: bucket already in group")
+	}
+	tags["bucket"] = struct{}{}
+	return tags, nil
+}
+
 func tagRename(args []parse.Node) (parse.Tags, error) {
 	tags, err := tagFirst(args)
 	if err != nil {
@@ -99,12 +111,60 @@ var Graphite = map[string]parse.Func{
 
 // TSDB defines functions for use with an OpenTSDB backend.
 var TSDB = map[string]parse.Func{
+	"above_ratio": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar, parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeScalar,
+		nil,
+		AboveRatio,
+	},
+	"above_seconds": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		AboveSeconds,
+	},
+	"active_for": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		ActiveFor,
+	},
+	"at_offset": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		AtOffset,
+	},
 	"band": {
 		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeScalar},
 		parse.TypeSeries,
 		tagQuery,
 		Band,
 	},
+	"baseline": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		Baseline,
+	},
+	"breaches": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		Breaches,
+	},
+	"burn_rate": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		BurnRate,
+	},
+	"cardinality": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString},
+		parse.TypeScalar,
+		nil,
+		Cardinality,
+	},
 	"change": {
 		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
 		parse.TypeNumber,
@@ -117,47 +177,299 @@ var TSDB = map[string]parse.Func{
 		nil,
 		Count,
 	},
+	"debug_series": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString},
+		parse.TypeSeries,
+		tagQuery,
+		DebugSeries,
+	},
+	"decay_avg": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		DecayAvg,
+	},
 	"diff": {
 		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
 		parse.TypeNumber,
 		tagQuery,
 		Diff,
 	},
+	"dyn_threshold": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		DynThreshold,
+	},
+	"flap_rate": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		FlapRate,
+	},
+	"in_band": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		InBand,
+	},
+	"increase": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		Increase,
+	},
+	"median_filter": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeSeries,
+		tagQuery,
+		MedianFilter,
+	},
+	"missing": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		Missing,
+	},
+	"missing_groups": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeScalar,
+		nil,
+		MissingGroups,
+	},
+	"nth_last": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		NthLast,
+	},
+	"pairs": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypePairs,
+		tagQuery,
+		PairsQuery,
+	},
+	"pct_above": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		PctAbove,
+	},
+	"pct_change": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		PctChange,
+	},
 	"q": {
 		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
 		parse.TypeSeries,
 		tagQuery,
 		Query,
 	},
+	"query_range": {
+		[]parse.FuncType{parse.TypeString, parse.TypeScalar, parse.TypeScalar, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		QueryRange,
+	},
+	"rate_budget": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		RateBudget,
+	},
+	"rate_ratio": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		RateRatio,
+	},
+	"rate_wrap": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		RateWrap,
+	},
+	"recovered": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		Recovered,
+	},
+	"same_time_last_week": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		SameTimeLastWeek,
+	},
+	"seasonal_zscore": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		SeasonalZScore,
+	},
+	"share": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeScalar,
+		nil,
+		Share,
+	},
+	"since_breach": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar},
+		parse.TypeNumber,
+		tagQuery,
+		SinceBreach,
+	},
+	"sla": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeScalar, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		SLA,
+	},
+	"wavg": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeScalar,
+		nil,
+		WAvg,
+	},
+	"xcorr_lag": {
+		[]parse.FuncType{parse.TypeString, parse.TypeString, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagQuery,
+		XCorrLag,
+	},
 }
 
 var builtins = map[string]parse.Func{
 	// Reduction functions
 
+	"acceleration": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		Acceleration,
+	},
+	"active_rate": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		ActiveRate,
+	},
 	"avg": {
 		[]parse.FuncType{parse.TypeSeries},
 		parse.TypeNumber,
 		tagFirst,
 		Avg,
 	},
+	"changepoint": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		ChangePoint,
+	},
+	"corr": {
+		[]parse.FuncType{parse.TypePairs},
+		parse.TypeNumber,
+		tagFirst,
+		Corr,
+	},
+	"crossings": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		Crossings,
+	},
+	"cusum": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar, parse.TypeScalar, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		CUSUM,
+	},
+	"cv": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		CV,
+	},
 	"dev": {
 		[]parse.FuncType{parse.TypeSeries},
 		parse.TypeNumber,
 		tagFirst,
 		Dev,
 	},
+	"dev_from_q": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		DevFromQ,
+	},
+	"entropy": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		Entropy,
+	},
+	"ewma": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		EWMA,
+	},
+	"ewvar": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		EWVar,
+	},
 	"first": {
 		[]parse.FuncType{parse.TypeSeries},
 		parse.TypeNumber,
 		tagFirst,
 		First,
 	},
+	"flatline": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		Flatline,
+	},
 	"forecastlr": {
 		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
 		parse.TypeNumber,
 		tagFirst,
 		Forecast_lr,
 	},
+	"frac_breaching": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeScalar},
+		parse.TypeScalar,
+		nil,
+		FracBreaching,
+	},
+	"geomean": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		GeoMean,
+	},
+	"grows_faster_than": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		GrowsFasterThan,
+	},
+	"highwater": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		Highwater,
+	},
+	"iqr": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		IQR,
+	},
 	"last": {
 		[]parse.FuncType{parse.TypeSeries},
 		parse.TypeNumber,
@@ -170,6 +482,12 @@ var builtins = map[string]parse.Func{
 		tagFirst,
 		Length,
 	},
+	"lowwater": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		Lowwater,
+	},
 	"max": {
 		[]parse.FuncType{parse.TypeSeries},
 		parse.TypeNumber,
@@ -188,12 +506,96 @@ var builtins = map[string]parse.Func{
 		tagFirst,
 		Min,
 	},
+	"mode": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		Mode,
+	},
+	"nan_rate": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		NaNRate,
+	},
+	"outliers": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		Outliers,
+	},
+	"p_ratio": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		PRatio,
+	},
 	"percentile": {
 		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
 		parse.TypeNumber,
 		tagFirst,
 		Percentile,
 	},
+	"period": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		Period,
+	},
+	"persisted_avg": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		PersistedAvg,
+	},
+	"persisted_max": {
+		[]parse.FuncType{parse.TypeNumber},
+		parse.TypeNumber,
+		tagFirst,
+		PersistedMax,
+	},
+	"persisted_min": {
+		[]parse.FuncType{parse.TypeNumber},
+		parse.TypeNumber,
+		tagFirst,
+		PersistedMin,
+	},
+	"poisson_anomaly": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		PoissonAnomaly,
+	},
+	"r2": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		R2,
+	},
+	"range": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		Range,
+	},
+	"reduce": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		Reduce,
+	},
+	"residual": {
+		[]parse.FuncType{parse.TypePairs, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		Residual,
+	},
+	"series_diff": {
+		[]parse.FuncType{parse.TypePairs, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		SeriesDiff,
+	},
 	"since": {
 		[]parse.FuncType{parse.TypeSeries},
 		parse.TypeNumber,
@@ -212,13 +614,79 @@ var builtins = map[string]parse.Func{
 		tagFirst,
 		Streak,
 	},
-
-	// Group functions
-	"rename": {
-		[]parse.FuncType{parse.TypeSeries, parse.TypeString},
-		parse.TypeSeries,
-		tagRename,
-		Rename,
+	"theilsen": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		TheilSen,
+	},
+	"time_to": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		TimeTo,
+	},
+	"tmax": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		TMax,
+	},
+	"tmin": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		TMin,
+	},
+	"trailing_nan": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		TrailingNaN,
+	},
+	"twa": {
+		[]parse.FuncType{parse.TypeSeries},
+		parse.TypeNumber,
+		tagFirst,
+		TWA,
+	},
+	"wpercentile": {
+		[]parse.FuncType{parse.TypePairs, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		WPercentile,
+	},
+
+	// Group functions
+	"bucketize": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeNumber,
+		tagBucket,
+		Bucketize,
+	},
+	"pick": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		Pick,
+	},
+	"rate_agg": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		RateAgg,
+	},
+	"rename": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeString},
+		parse.TypeSeries,
+		tagRename,
+		Rename,
+	},
+	"select": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeString, parse.TypeString},
+		parse.TypeScalar,
+		nil,
+		Select,
 	},
 
 	"t": {
@@ -233,6 +701,12 @@ var builtins = map[string]parse.Func{
 		nil,
 		Ungroup,
 	},
+	"worst_group": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		WorstGroup,
+	},
 
 	// Other functions
 
@@ -242,6 +716,18 @@ var builtins = map[string]parse.Func{
 		tagFirst,
 		Abs,
 	},
+	"coalesce": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeNumber},
+		parse.TypeNumber,
+		tagFirst,
+		Coalesce,
+	},
+	"convert": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeString, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		Convert,
+	},
 	"d": {
 		[]parse.FuncType{parse.TypeString},
 		parse.TypeScalar,
@@ -272,12 +758,54 @@ var builtins = map[string]parse.Func{
 		tagFirst,
 		Des,
 	},
+	"group_diff": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeNumber},
+		parse.TypeNumber,
+		tagFirst,
+		GroupDiff,
+	},
+	"group_intersect": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeNumber},
+		parse.TypeNumber,
+		tagFirst,
+		GroupIntersect,
+	},
+	"group_union": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeNumber},
+		parse.TypeNumber,
+		tagFirst,
+		GroupUnion,
+	},
+	"map": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		Map,
+	},
 	"nv": {
 		[]parse.FuncType{parse.TypeNumber, parse.TypeScalar},
 		parse.TypeNumber,
 		tagFirst,
 		NV,
 	},
+	"scale": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeScalar},
+		parse.TypeNumber,
+		tagFirst,
+		Scale,
+	},
+	"severity": {
+		[]parse.FuncType{parse.TypeNumber, parse.TypeScalar, parse.TypeScalar, parse.TypeString},
+		parse.TypeNumber,
+		tagFirst,
+		Severity,
+	},
+	"winsorize": {
+		[]parse.FuncType{parse.TypeSeries, parse.TypeScalar},
+		parse.TypeSeries,
+		tagFirst,
+		Winsorize,
+	},
 }
 
 func Epoch(e *State, T miniprofiler.Timer) (*Results, error) {
@@ -293,6 +821,84 @@ func NV(e *State, T miniprofiler.Timer, series *Results, v float64) (results *Re
 	return series, nil
 }
 
+// Severity returns 0, 1 or 2 per group when the value is ok, has reached
+// warn, or has reached crit. direction is "high" if higher values are worse
+// or "low" if lower values are worse. NaN values stay NaN.
+func Severity(e *State, T miniprofiler.Timer, series *Results, warn, crit float64, direction string) (*Results, error) {
+	var reached func(v, threshold float64) bool
+	switch direction {
+	case "high":
+		reached = func(v, threshold float64) bool { return v >= threshold }
+	case "low":
+		reached = func(v, threshold float64) bool { return v <= threshold }
+	default:
+		return nil, fmt.Errorf("severity: unknown direction %q, expected high or low", direction)
+	}
+	for _, res := range series.Results {
+		v := float64(res.Value.(Number))
+		switch {
+		case math.IsNaN(v):
+		case reached(v, crit):
+			v = 2
+		case reached(v, warn):
+			v = 1
+		default:
+			v = 0
+		}
+		res.Value = Number(v)
+	}
+	return series, nil
+}
+
+func Scale(e *State, T miniprofiler.Timer, series *Results, factor float64) (*Results, error) {
+	for _, res := range series.Results {
+		res.Value = Number(float64(res.Value.(Number)) * factor)
+	}
+	return series, nil
+}
+
+// unit is a unit of measure, expressed as a multiple of the base unit of its
+// kind.
+type unit struct {
+	kind   string
+	factor float64
+}
+
+// units lists the units known to convert().
+var units = map[string]unit{
+	"bytes": {"bytes", 1},
+	"KB":    {"bytes", 1e3},
+	"MB":    {"bytes", 1e6},
+	"GB":    {"bytes", 1e9},
+	"TB":    {"bytes", 1e12},
+	"KiB":   {"bytes", 1 << 10},
+	"MiB":   {"bytes", 1 << 20},
+	"GiB":   {"bytes", 1 << 30},
+	"TiB":   {"bytes", 1 << 40},
+	"bits":  {"bytes", 1.0 / 8},
+	"ns":    {"seconds", 1e-9},
+	"us":    {"seconds", 1e-6},
+	"ms":    {"seconds", 1e-3},
+	"s":     {"seconds", 1},
+	"min":   {"seconds", 60},
+	"h":     {"seconds", 3600},
+	"d":     {"seconds", 86400},
+}
+
+func Convert(e *State, T miniprofiler.Timer, series *Results, from, to string) (*Results, error) {
+	f, fok := units[from]
+	t, tok := units[to]
+	if !fok || !tok || f.kind != t.kind {
+		var names []string
+		for k := range units {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("convert: cannot convert %s to %s, expected two units of the same kind from: %s", from, to, strings.Join(names, ", "))
+	}
+	return Scale(e, T, series, f.factor/t.factor)
+}
+
 func Duration(e *State, T miniprofiler.Timer, d string) (*Results, error) {
 	duration, err := opentsdb.ParseDuration(d)
 	if err != nil {
@@ -305,6 +911,20 @@ func Duration(e *State, T miniprofiler.Timer, d string) (*Results, error) {
 	}, nil
 }
 
+// windowDuration parses s as the length of the window queried by fname. Unlike
+// end durations and offsets, a window may not be zero or negative, since the
+// query range would then be empty or reversed.
+func windowDuration(fname, s string) (opentsdb.Duration, error) {
+	d, err := opentsdb.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s: duration must be positive, got %q", fname, s)
+	}
+	return d, nil
+}
+
 func DropLe(e *State, T miniprofiler.Timer, series *Results, threshold float64) (*Results, error) {
 	for _, res := range series.Results {
 		nv := make(Series)
@@ -337,6 +957,36 @@ func DropNA(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
 	return series, nil
 }
 
+// Winsorize clamps the lowest and highest pct percent of the non-NaN points of
+// each series to the nearest remaining values, limiting the effect of outliers
+// on a later reduction.
+func Winsorize(e *State, T miniprofiler.Timer, series *Results, pct float64) (*Results, error) {
+	if pct < 0 || pct >= 50 {
+		return nil, fmt.Errorf("winsorize: pct must be in [0, 50), got %v", pct)
+	}
+	for _, res := range series.Results {
+		s := res.Value.(Series)
+		var x []float64
+		for _, v := range s {
+			if !math.IsNaN(v) {
+				x = append(x, v)
+			}
+		}
+		if len(x) == 0 {
+			continue
+		}
+		sort.Float64s(x)
+		k := int(float64(len(x)) * pct / 100)
+		lo, hi := x[k], x[len(x)-1-k]
+		w := make(Series, len(s))
+		for t, v := range s {
+			w[t] = math.Min(math.Max(v, lo), hi)
+		}
+		res.Value = w
+	}
+	return series, nil
+}
+
 func parseGraphiteResponse(req *graphite.Request, s *graphite.Response, formatTags []string) ([]*Result, error) {
 	if len(*s) == 0 {
 		return nil, fmt.Errorf("empty response for '%s' from %s to %s", req.Targets, req.Start, req.End)
@@ -395,11 +1045,11 @@ func GraphiteBand(e *State, T miniprofiler.Timer, query, duration, period, forma
 	r.IgnoreUnjoined = true
 	T.Step("graphiteBand", func(T miniprofiler.Timer) {
 		var d, p opentsdb.Duration
-		d, err = opentsdb.ParseDuration(duration)
+		d, err = windowDuration("graphiteBand", duration)
 		if err != nil {
 			return
 		}
-		p, err = opentsdb.ParseDuration(period)
+		p, err = windowDuration("graphiteBand", period)
 		if err != nil {
 			return
 		}
@@ -465,22 +1115,20 @@ func Band(e *State, T miniprofiler.Timer, query, duration, period string, num fl
 	r.IgnoreUnjoined = true
 	T.Step("band", func(T miniprofiler.Timer) {
 		var d, p opentsdb.Duration
-		d, err = opentsdb.ParseDuration(duration)
+		d, err = windowDuration("band", duration)
 		if err != nil {
 			return
 		}
-		p, err = opentsdb.ParseDuration(period)
+		p, err = windowDuration("band", period)
 		if err != nil {
 			return
 		}
 		if num < 1 || num > 100 {
 			err = fmt.Errorf("expr: Band: num out of bounds")
-		}
-		q, err := opentsdb.ParseQuery(query)
-		if q == nil && err != nil {
 			return
 		}
-		if err = e.Search.Expand(q); err != nil {
+		var q *opentsdb.Query
+		if q, err = parseQuery(e, "band", query); err != nil {
 			return
 		}
 		req := opentsdb.Request{
@@ -505,6 +1153,10 @@ func Band(e *State, T miniprofiler.Timer, query, duration, period string, num fl
 				if e.squelched(res.Tags) {
 					continue
 				}
+				var dps Series
+				if dps, err = dpsSeries(res.DPS); err != nil {
+					return
+				}
 				newarr := true
 				for _, a := range r.Results {
 					if !a.Group.Equal(res.Tags) {
@@ -512,28 +1164,15 @@ func Band(e *State, T miniprofiler.Timer, query, duration, period string, num fl
 					}
 					newarr = false
 					values := a.Value.(Series)
-					for k, v := range res.DPS {
-						i, e := strconv.ParseInt(k, 10, 64)
-						if e != nil {
-							err = e
-							return
-						}
-						values[time.Unix(i, 0).UTC()] = float64(v)
+					for t, v := range dps {
+						values[t] = v
 					}
 				}
 				if newarr {
-					values := make(Series)
-					a := &Result{Group: res.Tags}
-					for k, v := range res.DPS {
-						i, e := strconv.ParseInt(k, 10, 64)
-						if e != nil {
-							err = e
-							return
-						}
-						values[time.Unix(i, 0).UTC()] = float64(v)
-					}
-					a.Value = values
-					r.Results = append(r.Results, a)
+					r.Results = append(r.Results, &Result{
+						Value: dps,
+						Group: res.Tags,
+					})
 				}
 			}
 		}
@@ -541,8 +1180,19 @@ func Band(e *State, T miniprofiler.Timer, query, duration, period string, num fl
 	return
 }
 
+// Baseline returns the mean of query over the same duration-long window in
+// each of the num prior periods, making it a typical value to compare the
+// current window against.
+func Baseline(e *State, T miniprofiler.Timer, query, duration, period string, num float64) (r *Results, err error) {
+	r, err = Band(e, T, query, duration, period, num)
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, avg)
+}
+
 func GraphiteQuery(e *State, T miniprofiler.Timer, query string, sduration, eduration, format string) (r *Results, err error) {
-	sd, err := opentsdb.ParseDuration(sduration)
+	sd, err := windowDuration("graphite", sduration)
 	if err != nil {
 		return
 	}
@@ -571,7 +1221,7 @@ func GraphiteQuery(e *State, T miniprofiler.Timer, query string, sduration, edur
 		return nil, fmt.Errorf("graphite: %v", err)
 	}
 	r.Results = results
-
+	err = e.checkEmpty("graphite", query, len(r.Results))
 	return
 }
 
@@ -587,15 +1237,17 @@ func graphiteTagQuery(args []parse.Node) (parse.Tags, error) {
 }
 
 func Query(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
-	r = new(Results)
-	q, err := opentsdb.ParseQuery(query)
-	if q == nil && err != nil {
-		return
-	}
-	if err = e.Search.Expand(q); err != nil {
+	return namedQuery(e, T, "q", query, sduration, eduration)
+}
+
+// namedQuery is Query for the function fname, which prefixes errors about the
+// query and durations.
+func namedQuery(e *State, T miniprofiler.Timer, fname, query, sduration, eduration string) (r *Results, err error) {
+	q, err := parseQuery(e, fname, query)
+	if err != nil {
 		return
 	}
-	sd, err := opentsdb.ParseDuration(sduration)
+	sd, err := windowDuration(fname, sduration)
 	if err != nil {
 		return
 	}
@@ -611,25 +1263,43 @@ func Query(e *State, T miniprofiler.Timer, query, sduration, eduration string) (
 		}
 		req.End = fmt.Sprintf("%s-ago", ed)
 	}
-	var s opentsdb.ResponseSet
 	if err = req.SetTime(e.now); err != nil {
 		return
 	}
-	s, err = timeTSDBRequest(e, T, &req)
+	return queryRequest(e, T, fname, query, &req)
+}
+
+// parseQuery expands the variables and tag searches of query and parses it.
+func parseQuery(e *State, fname, query string) (q *opentsdb.Query, err error) {
+	if query, err = e.expandVars(fname, query); err != nil {
+		return
+	}
+	q, err = opentsdb.ParseQuery(query)
+	if q == nil && err != nil {
+		return
+	}
+	err = e.Search.Expand(q)
+	return
+}
+
+// queryRequest issues req and returns a series result for each group that is
+// not squelched.
+func queryRequest(e *State, T miniprofiler.Timer, fname, query string, req *opentsdb.Request) (r *Results, err error) {
+	r = new(Results)
+	s, err := timeTSDBRequest(e, T, req)
 	if err != nil {
 		return
 	}
+	if err = e.checkEmpty(fname, query, len(s)); err != nil {
+		return
+	}
 	for _, res := range s {
 		if e.squelched(res.Tags) {
 			continue
 		}
-		values := make(Series)
-		for k, v := range res.DPS {
-			i, err := strconv.ParseInt(k, 10, 64)
-			if err != nil {
-				return nil, err
-			}
-			values[time.Unix(i, 0).UTC()] = float64(v)
+		values, err := dpsSeries(res.DPS)
+		if err != nil {
+			return nil, err
 		}
 		r.Results = append(r.Results, &Result{
 			Value: values,
@@ -639,13 +1309,59 @@ func Query(e *State, T miniprofiler.Timer, query, sduration, eduration string) (
 	return
 }
 
+// QueryRange reduces query over the absolute time range from start to end,
+// given as Unix timestamps, with one of the aggregators accepted by reduce().
+func QueryRange(e *State, T miniprofiler.Timer, query string, start, end float64, reducerName string) (r *Results, err error) {
+	f, err := reducer("query_range", reducerName)
+	if err != nil {
+		return
+	}
+	if start >= end {
+		return nil, fmt.Errorf("query_range: start must be before end")
+	}
+	q, err := parseQuery(e, "query_range", query)
+	if err != nil {
+		return
+	}
+	req := opentsdb.Request{
+		Queries: []*opentsdb.Query{q},
+		Start:   int64(start),
+		End:     int64(end),
+	}
+	r, err = queryRequest(e, T, "query_range", query, &req)
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, f)
+}
+
+// dpsSeries converts OpenTSDB data points to a Series. Duplicate timestamps
+// in a response are already averaged when it is decoded (see
+// opentsdb.DPS.UnmarshalJSON).
+func dpsSeries(dps opentsdb.DPS) (Series, error) {
+	values := make(Series, len(dps))
+	for k, v := range dps {
+		i, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[time.Unix(i, 0).UTC()] = float64(v)
+	}
+	return values, nil
+}
+
 func timeGraphiteRequest(e *State, T miniprofiler.Timer, req *graphite.Request) (resp graphite.Response, err error) {
 	e.graphiteQueries = append(e.graphiteQueries, *req)
 	b, _ := json.MarshalIndent(req, "", "  ")
 	T.StepCustomTiming("graphite", "query", string(b), func() {
 		key := req.CacheKey()
 		getFn := func() (interface{}, error) {
-			return e.graphiteContext.Query(req)
+			e.stats.Queries++
+			r, err := e.graphiteContext.Query(req)
+			for _, s := range r {
+				e.stats.Points += len(s.Datapoints)
+			}
+			return r, err
 		}
 		var val interface{}
 		val, err = e.cache.Get(key, getFn)
@@ -664,7 +1380,12 @@ func timeTSDBRequest(e *State, T miniprofiler.Timer, req *opentsdb.Request) (s o
 	b, _ := json.MarshalIndent(req, "", "  ")
 	T.StepCustomTiming("tsdb", "query", string(b), func() {
 		getFn := func() (interface{}, error) {
-			return e.tsdbContext.Query(req)
+			e.stats.Queries++
+			rs, err := e.tsdbContext.Query(req)
+			for _, r := range rs {
+				e.stats.Points += len(r.DPS)
+			}
+			return rs, err
 		}
 		var val interface{}
 		val, err = e.cache.Get(string(b), getFn)
@@ -673,9 +1394,28 @@ func timeTSDBRequest(e *State, T miniprofiler.Timer, req *opentsdb.Request) (s o
 	return
 }
 
+// DebugSeries queries like q() over the last sduration and also attaches a copy
+// of each fetched series to its result as a computation, so the exact points
+// the expression was evaluated against are kept with the result.
+func DebugSeries(e *State, T miniprofiler.Timer, query, sduration string) (r *Results, err error) {
+	r, err = namedQuery(e, T, "debug_series", query, sduration, "")
+	if err != nil {
+		return
+	}
+	text := fmt.Sprintf("debug_series(%q, %q)", query, sduration)
+	for _, res := range r.Results {
+		s := make(Series)
+		for k, v := range res.Value.(Series) {
+			s[k] = v
+		}
+		res.AddComputation(text, s)
+	}
+	return
+}
+
 func Change(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
 	r = new(Results)
-	sd, err := opentsdb.ParseDuration(sduration)
+	sd, err := windowDuration("change", sduration)
 	if err != nil {
 		return
 	}
@@ -686,155 +1426,2082 @@ func Change(e *State, T miniprofiler.Timer, query, sduration, eduration string)
 			return
 		}
 	}
-	r, err = Query(e, T, query, sduration, eduration)
-	if err != nil {
-		return
-	}
-	r, err = reduce(e, T, r, change, (sd - ed).Seconds())
+	r, err = Query(e, T, query, sduration, eduration)
+	if err != nil {
+		return
+	}
+	r, err = reduce(e, T, r, change, (sd - ed).Seconds())
+	return
+}
+
+func change(dps Series, args ...float64) float64 {
+	return avg(dps) * args[0]
+}
+
+// Increase returns the total increase of a counter over the window. A drop in
+// value is treated as a counter reset, so the value after the drop counts as
+// increase from zero.
+func Increase(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
+	r, err = namedQuery(e, T, "increase", query, sduration, eduration)
+	if err != nil {
+		return
+	}
+	r, err = reduce(e, T, r, increase)
+	return
+}
+
+// AboveRatio returns the number of points above the threshold over the last
+// sduration in the groups whose tagk tag is tagvA, divided by the number in
+// those whose tagk tag is tagvB. It is NaN if the tagvB groups have none.
+func AboveRatio(e *State, T miniprofiler.Timer, query, sduration string, threshold float64, tagk, tagvA, tagvB string) (r *Results, err error) {
+	r, err = namedQuery(e, T, "above_ratio", query, sduration, "")
+	if err != nil {
+		return
+	}
+	var a, b float64
+	for _, res := range r.Results {
+		var n float64
+		for _, v := range res.Value.(Series) {
+			if v > threshold {
+				n++
+			}
+		}
+		switch res.Group[tagk] {
+		case tagvA:
+			a += n
+		case tagvB:
+			b += n
+		}
+	}
+	if b == 0 {
+		return wrap(math.NaN()), nil
+	}
+	return wrap(a / b), nil
+}
+
+// Share returns the fraction of the total increase of a counter over the
+// window that comes from the groups whose tagk tag is tagv. It is NaN if the
+// counter did not increase at all.
+func Share(e *State, T miniprofiler.Timer, query, sduration, tagk, tagv string) (r *Results, err error) {
+	r, err = namedQuery(e, T, "share", query, sduration, "")
+	if err != nil {
+		return
+	}
+	var part, total float64
+	for _, res := range r.Results {
+		inc := increase(res.Value.(Series))
+		total += inc
+		if res.Group[tagk] == tagv {
+			part += inc
+		}
+	}
+	if total == 0 {
+		return wrap(math.NaN()), nil
+	}
+	return wrap(part / total), nil
+}
+
+func increase(dps Series, args ...float64) (a float64) {
+	prev := math.NaN()
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if !math.IsNaN(prev) {
+			a += counterDelta(prev, p.V, 0)
+		}
+		prev = p.V
+	}
+	return
+}
+
+// counterDelta returns the increase of a counter from prev to cur. A drop is
+// a wraparound if max is positive and wrapping would be an increase of at
+// most half of max; otherwise it is a reset, and cur counts as increase from
+// zero.
+func counterDelta(prev, cur, max float64) float64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	if wrapped := max - prev + cur; max > 0 && wrapped <= max/2 {
+		return wrapped
+	}
+	return cur
+}
+
+// RateWrap returns the per-second rate of increase of a counter that wraps
+// around at max over the last sduration.
+func RateWrap(e *State, T miniprofiler.Timer, query, sduration string, max float64) (r *Results, err error) {
+	r, err = namedQuery(e, T, "rate_wrap", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, rateWrap, max)
+}
+
+// RateRatio returns the per-second rate of increase of a counter over the
+// last cduration divided by its rate over the last bduration, which must be at
+// least as long, so values well above 1 indicate a spike. Both rates come from
+// a single query over bduration. A drop in value is treated as a counter
+// reset, and a zero baseline rate results in NaN.
+func RateRatio(e *State, T miniprofiler.Timer, query, cduration, bduration string) (r *Results, err error) {
+	cd, err := windowDuration("rate_ratio", cduration)
+	if err != nil {
+		return
+	}
+	bd, err := windowDuration("rate_ratio", bduration)
+	if err != nil {
+		return
+	}
+	if cd > bd {
+		return nil, fmt.Errorf("rate_ratio: current duration %s is longer than baseline duration %s", cduration, bduration)
+	}
+	r, err = namedQuery(e, T, "rate_ratio", query, bduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, rateRatio, float64(e.now.Add(-time.Duration(cd)).Unix()))
+}
+
+// rateRatio is the reducer for RateRatio; its arg is the start of the
+// current window as a Unix time.
+func rateRatio(dps Series, args ...float64) float64 {
+	start := time.Unix(int64(args[0]), 0)
+	current := make(Series)
+	for t, v := range dps {
+		if !t.Before(start) {
+			current[t] = v
+		}
+	}
+	base := rateWrap(dps, 0)
+	if base == 0 {
+		return math.NaN()
+	}
+	return rateWrap(current, 0) / base
+}
+
+func rateWrap(dps Series, args ...float64) float64 {
+	var a float64
+	var first, prev SortablePoint
+	n := 0
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if n == 0 {
+			first = p
+		} else {
+			a += counterDelta(prev.V, p.V, args[0])
+		}
+		prev = p
+		n++
+	}
+	if n < 2 {
+		return math.NaN()
+	}
+	return a / prev.T.Sub(first.T).Seconds()
+}
+
+func ActiveRate(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
+	return reduce(e, T, series, activeRate)
+}
+
+// activeRate returns the per-second rate of increase of a counter over only
+// the intervals between consecutive points in which it increased, so flat and
+// reset intervals count toward neither the increase nor the time. It returns
+// NaN if the counter never increased.
+func activeRate(dps Series, args ...float64) float64 {
+	var increase, seconds float64
+	var prev SortablePoint
+	started := false
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if started && p.V > prev.V {
+			increase += p.V - prev.V
+			seconds += p.T.Sub(prev.T).Seconds()
+		}
+		prev, started = p, true
+	}
+	if seconds == 0 {
+		return math.NaN()
+	}
+	return increase / seconds
+}
+
+// minPeriodACF is the autocorrelation a peak must exceed for period to report
+// it as a seasonal period.
+const minPeriodACF = 0.3
+
+func Period(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
+	return reduce(e, T, series, period)
+}
+
+// period returns the dominant seasonal period of the series in seconds: the
+// lag, up to half the series, of the highest peak of its autocorrelation. It
+// assumes the non-NaN points are evenly spaced, and returns NaN if there is no
+// peak above minPeriodACF.
+func period(dps Series, args ...float64) float64 {
+	var s SortableSeries
+	for _, p := range NewSortedSeries(dps) {
+		if !math.IsNaN(p.V) {
+			s = append(s, p)
+		}
+	}
+	n := len(s)
+	if n < 4 {
+		return math.NaN()
+	}
+	var mean, variance float64
+	for _, p := range s {
+		mean += p.V
+	}
+	mean /= float64(n)
+	for _, p := range s {
+		variance += (p.V - mean) * (p.V - mean)
+	}
+	if variance == 0 {
+		return math.NaN()
+	}
+	acf := make([]float64, n/2+2)
+	for lag := range acf {
+		for i := 0; i+lag < n; i++ {
+			acf[lag] += (s[i].V - mean) * (s[i+lag].V - mean)
+		}
+		acf[lag] /= variance
+	}
+	best := 0
+	for lag := 1; lag <= n/2; lag++ {
+		if acf[lag] > acf[lag-1] && acf[lag] >= acf[lag+1] && acf[lag] > minPeriodACF && (best == 0 || acf[lag] > acf[best]) {
+			best = lag
+		}
+	}
+	if best == 0 {
+		return math.NaN()
+	}
+	step := s[n-1].T.Sub(s[0].T).Seconds() / float64(n-1)
+	return float64(best) * step
+}
+
+func Diff(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
+	r, err = Query(e, T, query, sduration, eduration)
+	if err != nil {
+		return
+	}
+	r, err = reduce(e, T, r, diff)
+	return
+}
+
+func diff(dps Series, args ...float64) float64 {
+	return last(dps) - first(dps)
+}
+
+// PctChange returns the percentage change of the average of query over
+// sduration against the same window offset into the past.
+func PctChange(e *State, T miniprofiler.Timer, query, sduration, offset string) (r *Results, err error) {
+	sd, err := windowDuration("pct_change", sduration)
+	if err != nil {
+		return
+	}
+	od, err := opentsdb.ParseDuration(offset)
+	if err != nil {
+		return
+	}
+	r, err = namedQuery(e, T, "pct_change", query, sduration, "")
+	if err != nil {
+		return
+	}
+	if r, err = reduce(e, T, r, avg); err != nil {
+		return
+	}
+	past, err := namedQuery(e, T, "pct_change", query, (sd + od).String(), od.String())
+	if err != nil {
+		return
+	}
+	if past, err = reduce(e, T, past, avg); err != nil {
+		return
+	}
+	for _, res := range r.Results {
+		v := math.NaN()
+		for _, p := range past.Results {
+			if !p.Group.Equal(res.Group) {
+				continue
+			}
+			if pv := float64(p.Value.(Number)); pv != 0 {
+				v = (float64(res.Value.(Number)) - pv) / pv * 100
+			}
+		}
+		res.Value = Number(v)
+	}
+	return
+}
+
+// SameTimeLastWeek returns the average of query over the sduration-long window
+// ending exactly seven days before now.
+func SameTimeLastWeek(e *State, T miniprofiler.Timer, query, sduration string) (r *Results, err error) {
+	sd, err := windowDuration("same_time_last_week", sduration)
+	if err != nil {
+		return
+	}
+	week := opentsdb.Duration(7 * 24 * time.Hour)
+	r, err = namedQuery(e, T, "same_time_last_week", query, (sd + week).String(), week.String())
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, avg)
+}
+
+// SeasonalZScore returns the z-score of the average of the last sduration
+// against the averages of the same window shifted back by 1 through count
+// multiples of period. Groups with fewer than two prior windows, or whose
+// prior windows all have the same average, are NaN.
+func SeasonalZScore(e *State, T miniprofiler.Timer, query, sduration, period string, count float64) (r *Results, err error) {
+	sd, err := windowDuration("seasonal_zscore", sduration)
+	if err != nil {
+		return
+	}
+	p, err := windowDuration("seasonal_zscore", period)
+	if err != nil {
+		return
+	}
+	if count < 2 || count > 100 {
+		return nil, fmt.Errorf("seasonal_zscore: count must be between 2 and 100, got %v", count)
+	}
+	r, err = namedQuery(e, T, "seasonal_zscore", query, sduration, "")
+	if err != nil {
+		return
+	}
+	if r, err = reduce(e, T, r, avg); err != nil {
+		return
+	}
+	// Each group's prior window averages, keyed by the end of the window.
+	baselines := make(map[string]Series)
+	for i := 1; i <= int(count); i++ {
+		offset := opentsdb.Duration(i) * p
+		var prior *Results
+		prior, err = namedQuery(e, T, "seasonal_zscore", query, (sd + offset).String(), offset.String())
+		if err != nil {
+			return
+		}
+		end := e.now.Add(-time.Duration(offset))
+		for _, res := range prior.Results {
+			dps := res.Value.(Series)
+			if len(dps) == 0 {
+				continue
+			}
+			g := res.Group.String()
+			if baselines[g] == nil {
+				baselines[g] = make(Series)
+			}
+			baselines[g][end] = avg(dps)
+		}
+	}
+	for _, res := range r.Results {
+		z := math.NaN()
+		if b := baselines[res.Group.String()]; len(b) >= 2 {
+			if d := dev(b); d != 0 {
+				z = (float64(res.Value.(Number)) - avg(b)) / d
+			}
+		}
+		res.Value = Number(z)
+	}
+	return
+}
+
+// Missing returns the fraction of the interval-sized slots over sduration
+// which contain no data.
+func Missing(e *State, T miniprofiler.Timer, query, sduration, interval string) (r *Results, err error) {
+	sd, err := windowDuration("missing", sduration)
+	if err != nil {
+		return
+	}
+	iv, err := opentsdb.ParseDuration(interval)
+	if err != nil {
+		return
+	}
+	if iv <= 0 || iv > sd {
+		return nil, fmt.Errorf("missing: interval must be positive and no longer than the duration")
+	}
+	r, err = namedQuery(e, T, "missing", query, sduration, "")
+	if err != nil {
+		return
+	}
+	slots := int64(sd / iv)
+	start := e.now.Add(-time.Duration(sd))
+	for _, res := range r.Results {
+		seen := make(map[int64]bool)
+		for t, v := range res.Value.(Series) {
+			if math.IsNaN(v) {
+				continue
+			}
+			if i := int64(t.Sub(start) / time.Duration(iv)); i >= 0 && i < slots {
+				seen[i] = true
+			}
+		}
+		res.Value = Number(1 - float64(len(seen))/float64(slots))
+	}
+	return
+}
+
+// MedianFilter queries the last sduration and replaces each point with the
+// median of the points around it, removing short spikes while preserving
+// sustained changes. window is either an odd number of points centered on
+// each point or a duration centered on each point's time.
+func MedianFilter(e *State, T miniprofiler.Timer, query, sduration, window string) (r *Results, err error) {
+	var count int
+	var width time.Duration
+	if n, aerr := strconv.Atoi(window); aerr == nil {
+		if n < 1 || n%2 == 0 {
+			return nil, fmt.Errorf("median_filter: window must be a positive odd number of points, got %d", n)
+		}
+		count = n
+	} else {
+		var d opentsdb.Duration
+		if d, err = opentsdb.ParseDuration(window); err != nil {
+			return nil, fmt.Errorf("median_filter: window must be a point count or a duration: %v", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("median_filter: window must be positive")
+		}
+		width = time.Duration(d)
+	}
+	r, err = namedQuery(e, T, "median_filter", query, sduration, "")
+	if err != nil {
+		return
+	}
+	for _, res := range r.Results {
+		s := NewSortedSeries(res.Value.(Series))
+		filtered := make(Series, len(s))
+		for i, p := range s {
+			lo, hi := i, i
+			if count > 0 {
+				lo, hi = i-count/2, i+count/2
+				if lo < 0 {
+					lo = 0
+				}
+				if hi > len(s)-1 {
+					hi = len(s) - 1
+				}
+			} else {
+				for lo > 0 && p.T.Sub(s[lo-1].T) <= width/2 {
+					lo--
+				}
+				for hi < len(s)-1 && s[hi+1].T.Sub(p.T) <= width/2 {
+					hi++
+				}
+			}
+			w := make(Series, hi-lo+1)
+			for _, q := range s[lo : hi+1] {
+				w[q.T] = q.V
+			}
+			filtered[p.T] = percentile(w, .5)
+		}
+		res.Value = filtered
+	}
+	return
+}
+
+// NthLast returns the value n points before the most recent one over the last
+// sduration, so n of 0 is the last value. NaN points are skipped, and NaN is
+// returned if there are not enough points.
+func NthLast(e *State, T miniprofiler.Timer, query, sduration string, n float64) (r *Results, err error) {
+	r, err = namedQuery(e, T, "nth_last", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, nthLast, n)
+}
+
+func nthLast(dps Series, args ...float64) float64 {
+	n := int(args[0])
+	s := NewSortedSeries(dps)
+	for i := len(s) - 1; i >= 0 && n >= 0; i-- {
+		if math.IsNaN(s[i].V) {
+			continue
+		}
+		if n == 0 {
+			return s[i].V
+		}
+		n--
+	}
+	return math.NaN()
+}
+
+// AtOffset returns the non-NaN value of the query over the last sduration
+// nearest to offset before now, or NaN if there is none within tolerance of
+// that time. Of two points equally near, the later one is used.
+func AtOffset(e *State, T miniprofiler.Timer, query, sduration, offset, tolerance string) (r *Results, err error) {
+	off, err := opentsdb.ParseDuration(offset)
+	if err != nil {
+		return
+	}
+	tol, err := opentsdb.ParseDuration(tolerance)
+	if err != nil {
+		return
+	}
+	if off < 0 || tol < 0 {
+		return nil, fmt.Errorf("at_offset: offset and tolerance must not be negative")
+	}
+	r, err = namedQuery(e, T, "at_offset", query, sduration, "")
+	if err != nil {
+		return
+	}
+	at := e.now.Add(-time.Duration(off))
+	return reduce(e, T, r, atOffset, float64(at.Unix()), time.Duration(tol).Seconds())
+}
+
+// atOffset is the reducer for AtOffset; args are the target time as a Unix
+// time and the tolerance in seconds.
+func atOffset(dps Series, args ...float64) float64 {
+	at, tolerance := time.Unix(int64(args[0]), 0), args[1]
+	v, best := math.NaN(), math.Inf(1)
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if d := math.Abs(p.T.Sub(at).Seconds()); d <= tolerance && d <= best {
+			v, best = p.V, d
+		}
+	}
+	return v
+}
+
+// DynThreshold returns the mean plus k standard deviations of the query over
+// the last sduration, so a current value can be compared against a threshold
+// derived from recent history. Groups with fewer than two non-NaN points are
+// NaN.
+func DynThreshold(e *State, T miniprofiler.Timer, query, sduration string, k float64) (r *Results, err error) {
+	r, err = namedQuery(e, T, "dyn_threshold", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, dynThreshold, k)
+}
+
+// dynThreshold is the reducer for DynThreshold; its arg is k, the number of
+// standard deviations above the mean.
+func dynThreshold(dps Series, args ...float64) float64 {
+	s := make(Series)
+	for t, v := range dps {
+		if !math.IsNaN(v) {
+			s[t] = v
+		}
+	}
+	if len(s) < 2 {
+		return math.NaN()
+	}
+	return avg(s) + args[0]*dev(s)
+}
+
+// InBand returns how much of the query over the last sduration stayed in the
+// band [center-tolerance, center+tolerance], as a fraction of its points.
+func InBand(e *State, T miniprofiler.Timer, query, sduration string, center, tolerance float64) (r *Results, err error) {
+	if tolerance < 0 {
+		return nil, fmt.Errorf("in_band: tolerance must not be negative, got %v", tolerance)
+	}
+	r, err = namedQuery(e, T, "in_band", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, inBand, center, tolerance)
+}
+
+// inBand returns the fraction of the non-NaN points of the series within
+// tolerance of center, inclusive, or NaN if there are none.
+func inBand(dps Series, args ...float64) float64 {
+	center, tolerance := args[0], args[1]
+	var in, total float64
+	for _, v := range dps {
+		if math.IsNaN(v) {
+			continue
+		}
+		total++
+		if math.Abs(v-center) <= tolerance {
+			in++
+		}
+	}
+	return in / total
+}
+
+// PctAbove returns the fraction of the last sduration during which query was
+// above threshold. In "count" mode it is the fraction of points above the
+// threshold. In "time" mode each point is weighted by the time until the next
+// point, or until the end of the window for the last one. NaN points are
+// ignored in both modes.
+func PctAbove(e *State, T miniprofiler.Timer, query, sduration string, threshold float64, mode string) (r *Results, err error) {
+	var byTime float64
+	switch mode {
+	case "count":
+	case "time":
+		byTime = 1
+	default:
+		return nil, fmt.Errorf("pct_above: unknown mode %q, expected count or time", mode)
+	}
+	r, err = namedQuery(e, T, "pct_above", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, pctAbove, threshold, byTime, float64(e.now.Unix()))
+}
+
+func pctAbove(dps Series, args ...float64) float64 {
+	threshold, byTime, end := args[0], args[1] != 0, time.Unix(int64(args[2]), 0)
+	var above, total float64
+	s := NewSortedSeries(dps)
+	for i, p := range s {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		w := 1.0
+		if byTime {
+			next := end
+			if i+1 < len(s) {
+				next = s[i+1].T
+			}
+			w = next.Sub(p.T).Seconds()
+		}
+		total += w
+		if p.V > threshold {
+			above += w
+		}
+	}
+	return above / total
+}
+
+// Breaches returns the largest number of points above threshold in any
+// window-long span of the query, which is high for bursts of breaches and low
+// when the same number of breaches is spread out.
+func Breaches(e *State, T miniprofiler.Timer, query, sduration string, threshold float64, window string) (r *Results, err error) {
+	w, err := windowDuration("breaches", window)
+	if err != nil {
+		return
+	}
+	r, err = namedQuery(e, T, "breaches", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, breaches, threshold, time.Duration(w).Seconds())
+}
+
+func breaches(dps Series, args ...float64) float64 {
+	threshold, width := args[0], time.Duration(args[1]*float64(time.Second))
+	var times []time.Time
+	for _, p := range NewSortedSeries(dps) {
+		if p.V > threshold {
+			times = append(times, p.T)
+		}
+	}
+	max, start := 0, 0
+	for i, t := range times {
+		for t.Sub(times[start]) >= width {
+			start++
+		}
+		if n := i - start + 1; n > max {
+			max = n
+		}
+	}
+	return float64(max)
+}
+
+// DecayAvg returns the average of query over sduration with each point
+// weighted by its age, halving the weight every halflife before now.
+func DecayAvg(e *State, T miniprofiler.Timer, query, sduration, halflife string) (r *Results, err error) {
+	h, err := windowDuration("decay_avg", halflife)
+	if err != nil {
+		return
+	}
+	r, err = namedQuery(e, T, "decay_avg", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, decayAvg, time.Duration(h).Seconds(), float64(e.now.Unix()))
+}
+
+func decayAvg(dps Series, args ...float64) float64 {
+	halflife, end := args[0], time.Unix(int64(args[1]), 0)
+	var total, weight float64
+	for t, v := range dps {
+		if math.IsNaN(v) {
+			continue
+		}
+		w := math.Pow(0.5, end.Sub(t).Seconds()/halflife)
+		total += v * w
+		weight += w
+	}
+	return total / weight
+}
+
+// SinceBreach returns the number of seconds since the most recent point of
+// query above threshold, or the length of the window if no point is.
+func SinceBreach(e *State, T miniprofiler.Timer, query, sduration string, threshold float64) (r *Results, err error) {
+	sd, err := windowDuration("since_breach", sduration)
+	if err != nil {
+		return
+	}
+	r, err = namedQuery(e, T, "since_breach", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, sinceBreach, threshold, float64(e.now.Unix()), time.Duration(sd).Seconds())
+}
+
+// sinceBreach is the reducer for SinceBreach; args are the threshold, the end
+// of the query as a Unix time, and the window in seconds returned if no point
+// breached.
+func sinceBreach(dps Series, args ...float64) float64 {
+	threshold, end, window := args[0], time.Unix(int64(args[1]), 0), args[2]
+	var last time.Time
+	for t, v := range dps {
+		if v > threshold && t.After(last) {
+			last = t
+		}
+	}
+	if last.IsZero() {
+		return window
+	}
+	return end.Sub(last).Seconds()
+}
+
+// FlapRate returns the number of times per hour over the last sduration that
+// the query, such as an alert's active flag, changed between zero and
+// nonzero. NaN values are skipped.
+func FlapRate(e *State, T miniprofiler.Timer, query, sduration string) (r *Results, err error) {
+	sd, err := windowDuration("flap_rate", sduration)
+	if err != nil {
+		return
+	}
+	r, err = namedQuery(e, T, "flap_rate", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, flapRate, time.Duration(sd).Hours())
+}
+
+// flapRate is the reducer for FlapRate; its arg is the window in hours.
+func flapRate(dps Series, args ...float64) float64 {
+	var n float64
+	started, active := false, false
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if v := p.V != 0; !started {
+			started, active = true, v
+		} else if v != active {
+			active = v
+			n++
+		}
+	}
+	return n / args[0]
+}
+
+// SLA returns the percentage of the time over the last sduration that the
+// query was on the good side of the threshold: at or above it if direction is
+// "higher", at or below it if "lower". Each value holds until the next one, and
+// the last until the end of the query.
+func SLA(e *State, T miniprofiler.Timer, query, sduration string, threshold float64, direction string) (r *Results, err error) {
+	var sign float64
+	switch direction {
+	case "higher":
+		sign = 1
+	case "lower":
+		sign = -1
+	default:
+		return nil, fmt.Errorf("sla: unknown direction %q, expected higher or lower", direction)
+	}
+	r, err = namedQuery(e, T, "sla", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, sla, threshold, sign, float64(e.now.Unix()))
+}
+
+// sla is the reducer for SLA; args are the threshold, 1 for "higher" or -1 for
+// "lower", and the end of the query as a Unix time.
+func sla(dps Series, args ...float64) float64 {
+	threshold, sign, end := args[0], args[1], time.Unix(int64(args[2]), 0)
+	good, seconds := stepSeconds(dps, end, func(v float64) bool {
+		return sign*(v-threshold) >= 0
+	})
+	return 100 * good / seconds
+}
+
+func AboveSeconds(e *State, T miniprofiler.Timer, query, sduration string, threshold float64) (r *Results, err error) {
+	r, err = namedQuery(e, T, "above_seconds", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, aboveSeconds, threshold, float64(e.now.Unix()))
+}
+
+// aboveSeconds returns the number of seconds the series spent above the
+// threshold, treating each value as holding until the next one and the last
+// until the end of the query.
+func aboveSeconds(dps Series, args ...float64) float64 {
+	threshold, end := args[0], time.Unix(int64(args[1]), 0)
+	above, _ := stepSeconds(dps, end, func(v float64) bool { return v > threshold })
+	return above
+}
+
+// stepSeconds treats each non-NaN value of the series as holding until the next
+// one, and the last until end. It returns the number of seconds covered by
+// values for which f is true, and the number covered in total.
+func stepSeconds(dps Series, end time.Time, f func(v float64) bool) (matched, total float64) {
+	eachStep(dps, end, func(v, seconds float64) {
+		if f(v) {
+			matched += seconds
+		}
+		total += seconds
+	})
+	return
+}
+
+// eachStep calls f, in time order, with each non-NaN value of the series and
+// the number of seconds it holds for: until the next value, or until end for
+// the last one.
+func eachStep(dps Series, end time.Time, f func(v, seconds float64)) {
+	var s SortableSeries
+	for _, p := range NewSortedSeries(dps) {
+		if !math.IsNaN(p.V) {
+			s = append(s, p)
+		}
+	}
+	for i, p := range s {
+		next := end
+		if i+1 < len(s) {
+			next = s[i+1].T
+		}
+		f(p.V, next.Sub(p.T).Seconds())
+	}
+}
+
+func Recovered(e *State, T miniprofiler.Timer, query, sduration string, threshold float64) (r *Results, err error) {
+	r, err = namedQuery(e, T, "recovered", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, recovered, threshold)
+}
+
+// recovered returns 1 if some point before the last was above the threshold
+// but the last is not, and 0 otherwise. NaN points are ignored.
+func recovered(dps Series, args ...float64) float64 {
+	threshold := args[0]
+	breached := false
+	var last float64
+	seen := false
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if seen && last > threshold {
+			breached = true
+		}
+		last, seen = p.V, true
+	}
+	if breached && last <= threshold {
+		return 1
+	}
+	return 0
+}
+
+func ActiveFor(e *State, T miniprofiler.Timer, query, sduration string, threshold float64) (r *Results, err error) {
+	r, err = namedQuery(e, T, "active_for", query, sduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, activeFor, threshold, float64(e.now.Unix()))
+}
+
+// activeFor returns the number of seconds between the start of the trailing
+// run of points above the threshold and the end of the query, or 0 if the
+// last point is not above it. NaN points neither extend nor end a run.
+func activeFor(dps Series, args ...float64) float64 {
+	threshold, end := args[0], time.Unix(int64(args[1]), 0)
+	var start time.Time
+	for _, p := range NewSortedSeries(dps) {
+		switch {
+		case math.IsNaN(p.V):
+		case p.V <= threshold:
+			start = time.Time{}
+		case start.IsZero():
+			start = p.T
+		}
+	}
+	if start.IsZero() {
+		return 0
+	}
+	return end.Sub(start).Seconds()
+}
+
+func reduce(e *State, T miniprofiler.Timer, series *Results, F func(Series, ...float64) float64, args ...float64) (*Results, error) {
+	res := *series
+	res.Results = nil
+	for _, s := range series.Results {
+		switch t := s.Value.(type) {
+		case Series:
+			if len(t) == 0 {
+				continue
+			}
+			s.Value = Number(F(t, args...))
+			res.Results = append(res.Results, s)
+		default:
+			panic(fmt.Errorf("expr: expected a series"))
+		}
+	}
+	return &res, nil
+}
+
+// reducers maps the aggregator names accepted by reduce() to their
+// implementations.
+var reducers = map[string]func(Series, ...float64) float64{
+	"avg":  avg,
+	"last": last,
+	"sum":  sum,
+	"min": func(dps Series, args ...float64) float64 {
+		return percentile(dps, 0)
+	},
+	"max": func(dps Series, args ...float64) float64 {
+		return percentile(dps, 1)
+	},
+}
+
+// rateReducers are the aggregators accepted by rate_agg().
+var rateReducers = map[string]func(Series, ...float64) float64{
+	"avg": reducers["avg"],
+	"max": reducers["max"],
+	"p95": func(dps Series, args ...float64) float64 {
+		return percentile(dps, .95)
+	},
+}
+
+// reducer returns the reducer registered under name. fname is used to
+// prefix the error for unknown names.
+func reducer(fname, name string) (func(Series, ...float64) float64, error) {
+	return lookupReducer(fname, name, reducers)
+}
+
+func lookupReducer(fname, name string, m map[string]func(Series, ...float64) float64) (func(Series, ...float64) float64, error) {
+	if f, ok := m[name]; ok {
+		return f, nil
+	}
+	var names []string
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("%s: unknown aggregator %q, expected one of: %s", fname, name, strings.Join(names, ", "))
+}
+
+func Reduce(e *State, T miniprofiler.Timer, series *Results, name string) (*Results, error) {
+	f, err := reducer("reduce", name)
+	if err != nil {
+		return nil, err
+	}
+	return reduce(e, T, series, f)
+}
+
+// RateAgg computes the per-second rate of each interval between consecutive
+// non-NaN points of a counter, dropping intervals where it reset, and reduces
+// those rates with the named aggregator. Series with no rates are NaN.
+func RateAgg(e *State, T miniprofiler.Timer, series *Results, name string) (*Results, error) {
+	f, err := lookupReducer("rate_agg", name, rateReducers)
+	if err != nil {
+		return nil, err
+	}
+	return reduce(e, T, series, func(dps Series, args ...float64) float64 {
+		rates := intervalRates(dps)
+		if len(rates) == 0 {
+			return math.NaN()
+		}
+		return f(rates)
+	})
+}
+
+// intervalRates returns the per-second rate of a counter over each interval
+// between consecutive non-NaN points, keyed by the end of the interval.
+// Intervals in which the counter reset are left out.
+func intervalRates(dps Series) Series {
+	rates := make(Series)
+	var prev SortablePoint
+	started := false
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if started && p.V >= prev.V {
+			rates[p.T] = (p.V - prev.V) / p.T.Sub(prev.T).Seconds()
+		}
+		prev, started = p, true
+	}
+	return rates
+}
+
+// RateBudget returns the per-second rate of a counter over the last sduration
+// minus the p-th percentile of its per-interval rates over the last
+// bduration, so a positive value means the counter is growing faster than
+// usual. Both come from a single query over bduration, which must be at least
+// as long as sduration. The current rate treats a drop as a counter reset, as
+// rate_ratio does, and intervals with a reset are left out of the percentile.
+func RateBudget(e *State, T miniprofiler.Timer, query, sduration, bduration string, p float64) (r *Results, err error) {
+	sd, err := windowDuration("rate_budget", sduration)
+	if err != nil {
+		return
+	}
+	bd, err := windowDuration("rate_budget", bduration)
+	if err != nil {
+		return
+	}
+	if sd > bd {
+		return nil, fmt.Errorf("rate_budget: duration %s is longer than baseline duration %s", sduration, bduration)
+	}
+	r, err = namedQuery(e, T, "rate_budget", query, bduration, "")
+	if err != nil {
+		return
+	}
+	return reduce(e, T, r, rateBudget, float64(e.now.Add(-time.Duration(sd)).Unix()), p)
+}
+
+// rateBudget is the reducer for RateBudget; args are the start of the current
+// window as a Unix time and the percentile of the historical rates to compare
+// against.
+func rateBudget(dps Series, args ...float64) float64 {
+	start := time.Unix(int64(args[0]), 0)
+	rates := intervalRates(dps)
+	if len(rates) == 0 {
+		return math.NaN()
+	}
+	current := make(Series)
+	for t, v := range dps {
+		if !t.Before(start) {
+			current[t] = v
+		}
+	}
+	return rateWrap(current, 0) - percentile(rates, args[1])
+}
+
+func Abs(e *State, T miniprofiler.Timer, series *Results) *Results {
+	for _, s := range series.Results {
+		s.Value = Number(math.Abs(float64(s.Value.Value().(Number))))
+	}
+	return series
+}
+
+// mapFuncs are the functions available to the expressions given to map().
+var mapFuncs = map[string]parse.Func{
+	"v": {
+		nil,
+		parse.TypeScalar,
+		nil,
+		mapValue,
+	},
+}
+
+// Map evaluates expr once per group of series, with v() returning that
+// group's value, and replaces the value with the result. expr may only use
+// arithmetic, comparisons and v().
+func Map(e *State, T miniprofiler.Timer, series *Results, expr string) (*Results, error) {
+	t, err := parse.Parse(expr, mapFuncs)
+	if err != nil {
+		return nil, fmt.Errorf("map: %v", err)
+	}
+	for _, s := range series.Results {
+		sub := *e
+		sub.walked = nil
+		sub.mapValue = float64(s.Value.Value().(Number))
+		s.Value = Number(sub.walk(t.Root, T).Results[0].Value.(Scalar))
+	}
+	return series, nil
+}
+
+func mapValue(e *State, T miniprofiler.Timer) *Results {
+	return wrap(e.mapValue)
+}
+
+// PersistedAvg blends each group's value with its blended value from the
+// previous execution, weighting the previous value by weight, so that
+// ExecuteWithPrior can smooth a value across executions. Groups without a
+// previous value, or executions without prior state, use the current value.
+func PersistedAvg(e *State, T miniprofiler.Timer, series *Results, weight float64) (*Results, error) {
+	if weight < 0 || weight > 1 {
+		return nil, fmt.Errorf("persisted_avg: weight must be between 0 and 1, got %v", weight)
+	}
+	for _, res := range series.Results {
+		key := e.call + res.Group.String()
+		v := float64(res.Value.(Number))
+		if prev, ok := e.prior[key]; ok && !math.IsNaN(prev) {
+			v = weight*prev + (1-weight)*v
+		}
+		if e.next != nil {
+			e.next[key] = v
+		}
+		res.Value = Number(v)
+	}
+	return series, nil
+}
+
+// PersistedMax returns, for each group, the larger of its value and its
+// result from the previous execution, so that with ExecuteWithPrior the result
+// is a high-water mark that never decreases. Marks of groups missing from an
+// execution are kept for later ones.
+func PersistedMax(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return persistedMark(e, series, func(prev, v float64) bool { return prev > v }), nil
+}
+
+// PersistedMin is like PersistedMax, but keeps the smaller value, giving a
+// low-water mark that never increases.
+func PersistedMin(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return persistedMark(e, series, func(prev, v float64) bool { return prev < v }), nil
+}
+
+// persistedMark replaces each group's value with its result from the previous
+// execution if the value is NaN or keep(prev, value) is true, and carries the
+// marks of missing groups over to the next execution.
+func persistedMark(e *State, series *Results, keep func(prev, v float64) bool) *Results {
+	for _, res := range series.Results {
+		key := e.call + res.Group.String()
+		v := float64(res.Value.(Number))
+		if prev, ok := e.prior[key]; ok && (math.IsNaN(v) || keep(prev, v)) {
+			v = prev
+		}
+		if e.next != nil {
+			e.next[key] = v
+		}
+		res.Value = Number(v)
+	}
+	if e.next != nil {
+		for key, v := range e.prior {
+			if _, ok := e.next[key]; !ok && strings.HasPrefix(key, e.call+"{") {
+				e.next[key] = v
+			}
+		}
+	}
+	return series
+}
+
+// FracBreaching returns the fraction of groups in series whose value exceeds
+// threshold. Groups with a NaN value are not counted, and if every group is
+// NaN the result is NaN.
+func FracBreaching(e *State, T miniprofiler.Timer, series *Results, threshold float64) *Results {
+	var breaching, total float64
+	for _, res := range series.Results {
+		v := float64(res.Value.(Number))
+		if math.IsNaN(v) {
+			continue
+		}
+		total++
+		if v > threshold {
+			breaching++
+		}
+	}
+	return wrap(breaching / total)
+}
+
+// Coalesce returns, per group, the value from a unless it is NaN, in which
+// case the value from b is used. Groups present in only one of a or b are
+// passed through.
+func Coalesce(e *State, T miniprofiler.Timer, a, b *Results) *Results {
+	r := *a
+	r.Results = nil
+	used := make(map[*Result]bool)
+	for _, ra := range a.Results {
+		res := ra
+		for _, rb := range b.Results {
+			if !rb.Group.Equal(ra.Group) {
+				continue
+			}
+			used[rb] = true
+			if math.IsNaN(float64(res.Value.(Number))) {
+				res = rb
+			}
+		}
+		r.Results = append(r.Results, res)
+	}
+	for _, rb := range b.Results {
+		if !used[rb] {
+			r.Results = append(r.Results, rb)
+		}
+	}
+	return &r
+}
+
+// hasGroup reports whether r has a result for group g.
+func hasGroup(r *Results, g opentsdb.TagSet) bool {
+	for _, res := range r.Results {
+		if res.Group.Equal(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterGroups returns the results of a whose presence in b is want.
+func filterGroups(a, b *Results, want bool) *Results {
+	r := *a
+	r.Results = nil
+	for _, res := range a.Results {
+		if hasGroup(b, res.Group) == want {
+			r.Results = append(r.Results, res)
+		}
+	}
+	return &r
+}
+
+// GroupDiff returns the results of a whose groups are not in b.
+func GroupDiff(e *State, T miniprofiler.Timer, a, b *Results) *Results {
+	return filterGroups(a, b, false)
+}
+
+// GroupIntersect returns the results of a whose groups are also in b.
+func GroupIntersect(e *State, T miniprofiler.Timer, a, b *Results) *Results {
+	return filterGroups(a, b, true)
+}
+
+// GroupUnion returns the results of a followed by the results of b whose
+// groups are not in a.
+func GroupUnion(e *State, T miniprofiler.Timer, a, b *Results) *Results {
+	r := *a
+	r.Results = append(append(ResultSlice(nil), a.Results...), filterGroups(b, a, false).Results...)
+	return &r
+}
+
+func Avg(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, avg)
+}
+
+// avg returns the mean of x.
+func avg(dps Series, args ...float64) (a float64) {
+	for _, v := range dps {
+		a += float64(v)
+	}
+	a /= float64(len(dps))
+	return
+}
+
+func Count(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
+	r, err = Query(e, T, query, sduration, eduration)
+	if err != nil {
+		return
+	}
+	return &Results{
+		Results: []*Result{
+			{Value: Scalar(len(r.Results))},
+		},
+	}, nil
+}
+
+// Cardinality returns the number of distinct tag sets with at least one data
+// point over the last sduration. Unlike count, groups returned without data
+// and repeated tag sets are not counted.
+func Cardinality(e *State, T miniprofiler.Timer, query, sduration string) (r *Results, err error) {
+	r, err = namedQuery(e, T, "cardinality", query, sduration, "")
+	if err != nil {
+		return
+	}
+	groups := make(map[string]bool)
+	for _, res := range r.Results {
+		if len(res.Value.(Series)) > 0 {
+			groups[res.Group.String()] = true
+		}
+	}
+	return wrap(float64(len(groups))), nil
+}
+
+// MissingGroups returns the number of groups of expectedQuery for which query
+// has no data over the last sduration, such as hosts that should be reporting
+// but are not. group_diff gives the groups themselves.
+func MissingGroups(e *State, T miniprofiler.Timer, query, sduration, expectedQuery string) (r *Results, err error) {
+	r, err = namedQuery(e, T, "missing_groups", query, sduration, "")
+	if err != nil {
+		return
+	}
+	expected, err := namedQuery(e, T, "missing_groups", expectedQuery, sduration, "")
+	if err != nil {
+		return
+	}
+	reporting := *r
+	reporting.Results = nil
+	for _, res := range r.Results {
+		if len(res.Value.(Series)) > 0 {
+			reporting.Results = append(reporting.Results, res)
+		}
+	}
+	return wrap(float64(len(filterGroups(expected, &reporting, false).Results))), nil
+}
+
+// WAvg returns the average of the groups of query weighted by the matching
+// groups of weightQuery, each averaged over sduration. Groups without a
+// matching weight are ignored, and a zero total weight results in NaN.
+func WAvg(e *State, T miniprofiler.Timer, query, weightQuery, sduration string) (r *Results, err error) {
+	values, err := namedQuery(e, T, "wavg", query, sduration, "")
+	if err != nil {
+		return
+	}
+	weights, err := namedQuery(e, T, "wavg", weightQuery, sduration, "")
+	if err != nil {
+		return
+	}
+	var total, weight float64
+	for _, v := range values.Results {
+		for _, w := range weights.Results {
+			if !w.Group.Equal(v.Group) {
+				continue
+			}
+			vs, ws := v.Value.(Series), w.Value.(Series)
+			if len(vs) == 0 || len(ws) == 0 {
+				continue
+			}
+			wv := avg(ws)
+			total += avg(vs) * wv
+			weight += wv
+		}
+	}
+	if weight == 0 {
+		return wrap(math.NaN()), nil
+	}
+	return wrap(total / weight), nil
+}
+
+// PairsQuery returns, for each group present in both query and bQuery, the
+// points of the two series aligned on their timestamps. Times present in only
+// one of the series are dropped.
+func PairsQuery(e *State, T miniprofiler.Timer, query, bQuery, sduration string) (r *Results, err error) {
+	a, err := namedQuery(e, T, "pairs", query, sduration, "")
+	if err != nil {
+		return
+	}
+	b, err := namedQuery(e, T, "pairs", bQuery, sduration, "")
+	if err != nil {
+		return
+	}
+	r = new(Results)
+	for _, ra := range a.Results {
+		for _, rb := range b.Results {
+			if !rb.Group.Equal(ra.Group) {
+				continue
+			}
+			as, bs := ra.Value.(Series), rb.Value.(Series)
+			p := make(Pairs)
+			for t, v := range as {
+				if bv, ok := bs[t]; ok {
+					p[t] = Pair{v, bv}
+				}
+			}
+			r.Results = append(r.Results, &Result{
+				Value: p,
+				Group: ra.Group,
+			})
+		}
+	}
+	return
+}
+
+// Residual returns, for each group of pairs, the named aggregate, such as avg
+// or max, of the absolute differences between the two sides, such as observed
+// values and a baseline, or NaN if there are no pairs.
+func Residual(e *State, T miniprofiler.Timer, pairs *Results, name string) (*Results, error) {
+	return reducePairs("residual", pairs, name, func(p Pair) float64 { return math.Abs(p.A - p.B) })
+}
+
+// SeriesDiff subtracts the second side of each group of pairs from the first,
+// and reduces the differences with the named aggregator. Groups with no pairs
+// are NaN.
+func SeriesDiff(e *State, T miniprofiler.Timer, pairs *Results, name string) (*Results, error) {
+	return reducePairs("series_diff", pairs, name, func(p Pair) float64 { return p.A - p.B })
+}
+
+// reducePairs replaces each group of pairs with the named reducer applied to
+// diff of each pair, or NaN if the group has no pairs.
+func reducePairs(fname string, pairs *Results, name string, diff func(Pair) float64) (*Results, error) {
+	f, err := reducer(fname, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range pairs.Results {
+		d := make(Series)
+		for t, v := range res.Value.(Pairs) {
+			d[t] = diff(v)
+		}
+		r := math.NaN()
+		if len(d) > 0 {
+			r = f(d)
+		}
+		res.Value = Number(r)
+	}
+	return pairs, nil
+}
+
+// WPercentile returns, for each group of pairs of values and weights, the
+// smallest value at or below which at least a fraction p of the total weight
+// lies. Pairs with a NaN value or a weight that is not positive are ignored,
+// and groups with no weight are NaN.
+func WPercentile(e *State, T miniprofiler.Timer, pairs *Results, p float64) *Results {
+	for _, res := range pairs.Results {
+		var s pairsByA
+		var total float64
+		for _, v := range res.Value.(Pairs) {
+			if !math.IsNaN(v.A) && v.B > 0 {
+				s = append(s, v)
+				total += v.B
+			}
+		}
+		sort.Sort(s)
+		r := math.NaN()
+		var cum float64
+		for _, v := range s {
+			cum += v.B
+			if cum >= p*total {
+				r = v.A
+				break
+			}
+		}
+		res.Value = Number(r)
+	}
+	return pairs
+}
+
+type pairsByA []Pair
+
+func (p pairsByA) Len() int           { return len(p) }
+func (p pairsByA) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p pairsByA) Less(i, j int) bool { return p[i].A < p[j].A }
+
+// Corr returns the Pearson correlation coefficient of each group of pairs, or
+// NaN if there are fewer than two pairs or either side is constant.
+func Corr(e *State, T miniprofiler.Timer, pairs *Results) *Results {
+	for _, res := range pairs.Results {
+		res.Value = Number(pearson(res.Value.(Pairs)))
+	}
+	return pairs
+}
+
+// pearson returns the Pearson correlation coefficient of p, or NaN if there
+// are fewer than two pairs or either side is constant.
+func pearson(p Pairs) float64 {
+	n := float64(len(p))
+	var sa, sb, saa, sbb, sab float64
+	for _, v := range p {
+		sa += v.A
+		sb += v.B
+		saa += v.A * v.A
+		sbb += v.B * v.B
+		sab += v.A * v.B
+	}
+	if d := math.Sqrt((n*saa - sa*sa) * (n*sbb - sb*sb)); n >= 2 && d != 0 {
+		return (n*sab - sa*sb) / d
+	}
+	return math.NaN()
+}
+
+// minXCorrPairs is the number of overlapping points xcorr_lag needs at a lag
+// to consider it.
+const minXCorrPairs = 3
+
+// XCorrLag returns, for each group of query with a matching group of bQuery,
+// the lag in seconds within maxLag at which the two are most correlated.
+// Lags are multiples of query's sampling interval, and a positive lag means
+// bQuery follows query. Ties go to the smallest lag, and groups with no lag
+// giving a correlation are NaN.
+func XCorrLag(e *State, T miniprofiler.Timer, query, bQuery, sduration, maxLag string) (r *Results, err error) {
+	ml, err := opentsdb.ParseDuration(maxLag)
+	if err != nil {
+		return
+	}
+	if ml < 0 {
+		return nil, fmt.Errorf("xcorr_lag: maxLag must not be negative, got %q", maxLag)
+	}
+	r, err = namedQuery(e, T, "xcorr_lag", query, sduration, "")
+	if err != nil {
+		return
+	}
+	b, err := namedQuery(e, T, "xcorr_lag", bQuery, sduration, "")
+	if err != nil {
+		return
+	}
+	for _, ra := range r.Results {
+		lag := math.NaN()
+		for _, rb := range b.Results {
+			if rb.Group.Equal(ra.Group) {
+				lag = xcorrLag(ra.Value.(Series), rb.Value.(Series), time.Duration(ml))
+				break
+			}
+		}
+		ra.Value = Number(lag)
+	}
+	return
+}
+
+func xcorrLag(a, b Series, maxLag time.Duration) float64 {
+	var s SortableSeries
+	for _, p := range NewSortedSeries(a) {
+		if !math.IsNaN(p.V) {
+			s = append(s, p)
+		}
+	}
+	var step time.Duration
+	for i := 1; i < len(s); i++ {
+		if d := s[i].T.Sub(s[i-1].T); step == 0 || d < step {
+			step = d
+		}
+	}
+	if step == 0 {
+		return math.NaN()
+	}
+	best, bestCorr := math.NaN(), math.Inf(-1)
+	k := int(maxLag / step)
+	for i := 0; i <= 2*k; i++ {
+		// Visit 0, -1, +1, -2, +2, ... so ties go to the smallest lag.
+		l := (i + 1) / 2
+		if i%2 == 1 {
+			l = -l
+		}
+		lag := time.Duration(l) * step
+		p := make(Pairs)
+		for _, pa := range s {
+			if bv, ok := b[pa.T.Add(lag)]; ok && !math.IsNaN(bv) {
+				p[pa.T] = Pair{pa.V, bv}
+			}
+		}
+		if len(p) < minXCorrPairs {
+			continue
+		}
+		if c := pearson(p); c > bestCorr {
+			best, bestCorr = lag.Seconds(), c
+		}
+	}
+	return best
+}
+
+// BurnRate returns, for each group present in both goodQuery and totalQuery,
+// the rate at which the error budget of an SLO with the given target is being
+// spent over sduration: the error ratio 1 - good/total divided by the allowed
+// error ratio 1 - target. Groups with no total events are NaN.
+func BurnRate(e *State, T miniprofiler.Timer, goodQuery, totalQuery, sduration string, target float64) (r *Results, err error) {
+	if target <= 0 || target >= 1 {
+		return nil, fmt.Errorf("burn_rate: target must be between 0 and 1, got %v", target)
+	}
+	good, err := namedQuery(e, T, "burn_rate", goodQuery, sduration, "")
+	if err != nil {
+		return
+	}
+	if good, err = reduce(e, T, good, sum); err != nil {
+		return
+	}
+	total, err := namedQuery(e, T, "burn_rate", totalQuery, sduration, "")
+	if err != nil {
+		return
+	}
+	if total, err = reduce(e, T, total, sum); err != nil {
+		return
+	}
+	r = new(Results)
+	for _, g := range good.Results {
+		for _, t := range total.Results {
+			if !t.Group.Equal(g.Group) {
+				continue
+			}
+			v := math.NaN()
+			if tv := float64(t.Value.(Number)); tv != 0 {
+				v = (1 - float64(g.Value.(Number))/tv) / (1 - target)
+			}
+			g.Value = Number(v)
+			r.Results = append(r.Results, g)
+		}
+	}
+	return
+}
+
+func Sum(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, sum)
+}
+
+func sum(dps Series, args ...float64) (a float64) {
+	for _, v := range dps {
+		a += float64(v)
+	}
+	return
+}
+
+func Des(e *State, T miniprofiler.Timer, series *Results, alpha float64, beta float64) *Results {
+	for _, res := range series.Results {
+		sorted := NewSortedSeries(res.Value.Value().(Series))
+		if len(sorted) < 2 {
+			continue
+		}
+		des := make(Series)
+		s := make([]float64, len(sorted))
+		b := make([]float64, len(sorted))
+		s[0] = sorted[0].V
+		for i := 1; i < len(sorted); i++ {
+			s[i] = alpha*sorted[i].V + (1-alpha)*(s[i-1]+b[i-1])
+			b[i] = beta*(s[i]-s[i-1]) + (1-beta)*b[i-1]
+			des[sorted[i].T] = s[i]
+		}
+		res.Value = des
+	}
+	return series
+}
+
+func Streak(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, streak)
+}
+
+func streak(dps Series, args ...float64) (a float64) {
+	max := func(a, b int) int {
+		if a > b {
+			return a
+		}
+		return b
+	}
+
+	series := NewSortedSeries(dps)
+
+	current := 0
+	longest := 0
+	for _, p := range series {
+		if p.V != 0 {
+			current++
+		} else {
+			longest = max(current, longest)
+			current = 0
+		}
+	}
+	longest = max(current, longest)
+	return float64(longest)
+}
+
+func TMax(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, textreme, 1)
+}
+
+func TMin(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, textreme, -1)
+}
+
+// textreme returns the Unix time of the maximum value of dps if args[0] is
+// positive, else of the minimum. Ties are resolved to the earliest time, and
+// NaN values are ignored.
+func textreme(dps Series, args ...float64) float64 {
+	a := math.NaN()
+	var at time.Time
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if math.IsNaN(a) || (args[0] > 0 && p.V > a) || (args[0] < 0 && p.V < a) {
+			a = p.V
+			at = p.T
+		}
+	}
+	if math.IsNaN(a) {
+		return a
+	}
+	return float64(at.Unix())
+}
+
+func Dev(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, dev)
+}
+
+// dev returns the sample standard deviation of x.
+func dev(dps Series, args ...float64) (d float64) {
+	if len(dps) == 1 {
+		return 0
+	}
+	a := avg(dps)
+	for _, v := range dps {
+		d += math.Pow(float64(v)-a, 2)
+	}
+	d /= float64(len(dps) - 1)
+	return math.Sqrt(d)
+}
+
+func ChangePoint(e *State, T miniprofiler.Timer, series *Results, sensitivity float64) (*Results, error) {
+	return reduce(e, T, series, changePoint, sensitivity)
+}
+
+// changePoint splits the series in half by time and returns 1 if the means of
+// the halves differ by more than sensitivity times their pooled standard
+// deviation, otherwise 0. It returns NaN if either half has fewer than two
+// points.
+func changePoint(dps Series, args ...float64) float64 {
+	s := NewSortedSeries(dps)
+	if len(s) < 4 {
+		return math.NaN()
+	}
+	first, second := make(Series), make(Series)
+	for i, p := range s {
+		if i < len(s)/2 {
+			first[p.T] = p.V
+		} else {
+			second[p.T] = p.V
+		}
+	}
+	d1, d2 := dev(first), dev(second)
+	n1, n2 := float64(len(first)), float64(len(second))
+	sd := math.Sqrt((d1*d1*(n1-1) + d2*d2*(n2-1)) / (n1 + n2 - 2))
+	if math.Abs(avg(second)-avg(first)) > args[0]*sd {
+		return 1
+	}
+	return 0
+}
+
+func CV(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, cv)
+}
+
+// cv returns the coefficient of variation of x: its standard deviation divided
+// by its mean, or NaN if the mean is zero.
+func cv(dps Series, args ...float64) float64 {
+	a := avg(dps)
+	if a == 0 {
+		return math.NaN()
+	}
+	return dev(dps) / a
+}
+
+func Mode(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, mode)
+}
+
+// mode returns the most frequent non-NaN value of x, preferring the smallest
+// value on a tie, or NaN if there are none.
+func mode(dps Series, args ...float64) float64 {
+	counts := make(map[float64]int)
+	for _, v := range dps {
+		if !math.IsNaN(v) {
+			counts[v]++
+		}
+	}
+	m, n := math.NaN(), 0
+	for v, c := range counts {
+		if c > n || c == n && v < m {
+			m, n = v, c
+		}
+	}
+	return m
+}
+
+func Entropy(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, entropy)
+}
+
+// entropy returns the Shannon entropy, in bits, of the distribution of the
+// non-NaN values of dps, or NaN if there are none.
+func entropy(dps Series, args ...float64) (h float64) {
+	counts := make(map[float64]int)
+	n := 0
+	for _, v := range dps {
+		if !math.IsNaN(v) {
+			counts[v]++
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		h -= p * math.Log2(p)
+	}
+	return
+}
+
+func NaNRate(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, nanRate)
+}
+
+// nanRate returns the fraction of the points of x that are NaN.
+func nanRate(dps Series, args ...float64) float64 {
+	var n float64
+	for _, v := range dps {
+		if math.IsNaN(v) {
+			n++
+		}
+	}
+	return n / float64(len(dps))
+}
+
+func Crossings(e *State, T miniprofiler.Timer, series *Results, threshold float64) (*Results, error) {
+	return reduce(e, T, series, crossings, threshold)
+}
+
+// crossings returns the number of times the series moves from one side of
+// the threshold to the other. Values equal to the threshold are below it, and
+// NaN values are skipped, so a gap does not count as a crossing.
+func crossings(dps Series, args ...float64) (a float64) {
+	threshold := args[0]
+	started, above := false, false
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if v := p.V > threshold; !started {
+			started, above = true, v
+		} else if v != above {
+			above = v
+			a++
+		}
+	}
 	return
 }
 
-func change(dps Series, args ...float64) float64 {
-	return avg(dps) * args[0]
+func Flatline(e *State, T miniprofiler.Timer, series *Results, epsilon float64) (*Results, error) {
+	return reduce(e, T, series, flatline, epsilon)
 }
 
-func Diff(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
-	r, err = Query(e, T, query, sduration, eduration)
-	if err != nil {
-		return
+// flatline returns 1 if the non-NaN values of the series are all within
+// epsilon of each other, otherwise 0, or NaN if there are no such values.
+func flatline(dps Series, args ...float64) float64 {
+	r := valueRange(dps)
+	switch {
+	case math.IsNaN(r):
+		return math.NaN()
+	case r <= args[0]:
+		return 1
 	}
-	r, err = reduce(e, T, r, diff)
-	return
+	return 0
 }
 
-func diff(dps Series, args ...float64) float64 {
-	return last(dps) - first(dps)
+func Highwater(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, highwater)
 }
 
-func reduce(e *State, T miniprofiler.Timer, series *Results, F func(Series, ...float64) float64, args ...float64) (*Results, error) {
-	res := *series
-	res.Results = nil
-	for _, s := range series.Results {
-		switch t := s.Value.(type) {
-		case Series:
-			if len(t) == 0 {
-				continue
-			}
-			s.Value = Number(F(t, args...))
-			res.Results = append(res.Results, s)
-		default:
-			panic(fmt.Errorf("expr: expected a series"))
+func Lowwater(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, lowwater)
+}
+
+// lowwater returns the smallest non-NaN value of the series, or NaN if there
+// are none.
+func lowwater(dps Series, args ...float64) float64 {
+	min := math.NaN()
+	for _, v := range dps {
+		if math.IsNaN(min) || v < min {
+			min = v
 		}
 	}
-	return &res, nil
+	return min
 }
 
-func Abs(e *State, T miniprofiler.Timer, series *Results) *Results {
-	for _, s := range series.Results {
-		s.Value = Number(math.Abs(float64(s.Value.Value().(Number))))
+// highwater returns the largest non-NaN value of the series, or NaN if there
+// are none.
+func highwater(dps Series, args ...float64) float64 {
+	max := math.NaN()
+	for _, v := range dps {
+		if math.IsNaN(max) || v > max {
+			max = v
+		}
 	}
-	return series
+	return max
 }
 
-func Avg(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
-	return reduce(e, T, series, avg)
+func PoissonAnomaly(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, poissonAnomaly)
 }
 
-// avg returns the mean of x.
-func avg(dps Series, args ...float64) (a float64) {
-	for _, v := range dps {
-		a += float64(v)
+// poissonAnomaly models the points of the series before the last as Poisson
+// distributed event counts, and returns the probability of a count at least as
+// large as the last point. It returns NaN with fewer than two earlier points.
+func poissonAnomaly(dps Series, args ...float64) float64 {
+	var s SortableSeries
+	for _, p := range NewSortedSeries(dps) {
+		if !math.IsNaN(p.V) {
+			s = append(s, p)
+		}
 	}
-	a /= float64(len(dps))
-	return
+	if len(s) < 3 {
+		return math.NaN()
+	}
+	history, current := s[:len(s)-1], math.Ceil(s[len(s)-1].V)
+	var lambda float64
+	for _, p := range history {
+		lambda += p.V
+	}
+	lambda /= float64(len(history))
+	return poissonTail(current, lambda)
 }
 
-func Count(e *State, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
-	r, err = Query(e, T, query, sduration, eduration)
-	if err != nil {
-		return
+// poissonTail returns P(X >= k) for X Poisson distributed with mean lambda.
+// It sums the pmf away from k toward the nearer tail, starting from its value
+// at k computed in log space, so it neither underflows for large lambda nor
+// takes more than a few multiples of sqrt(lambda) steps.
+func poissonTail(k, lambda float64) float64 {
+	if k <= 0 {
+		return 1
 	}
-	return &Results{
-		Results: []*Result{
-			{Value: Scalar(len(r.Results))},
-		},
-	}, nil
+	if lambda <= 0 {
+		return 0
+	}
+	logPMF := func(i float64) float64 {
+		lg, _ := math.Lgamma(i + 1)
+		return i*math.Log(lambda) - lambda - lg
+	}
+	var sum float64
+	if k > lambda {
+		// Sum the upper tail directly: pmf(i+1) = pmf(i) * lambda / (i+1).
+		for i, pmf := k, math.Exp(logPMF(k)); pmf > sum*1e-17; i++ {
+			sum += pmf
+			pmf *= lambda / (i + 1)
+		}
+		return math.Min(1, sum)
+	}
+	// Sum the lower tail below k: pmf(i-1) = pmf(i) * i / lambda.
+	for i, pmf := k-1, math.Exp(logPMF(k-1)); i >= 0 && pmf > sum*1e-17; i-- {
+		sum += pmf
+		pmf *= i / lambda
+	}
+	return math.Max(0, 1-sum)
 }
 
-func Sum(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
-	return reduce(e, T, series, sum)
+func TWA(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, twa)
 }
 
-func sum(dps Series, args ...float64) (a float64) {
-	for _, v := range dps {
-		a += float64(v)
+// twa returns the time-weighted average of the series, treating each non-NaN
+// value as holding until the next one. The last value ends the series and so
+// carries no weight unless it is the only one.
+func twa(dps Series, args ...float64) float64 {
+	var end time.Time
+	last := math.NaN()
+	for t, v := range dps {
+		if !math.IsNaN(v) && (end.IsZero() || t.After(end)) {
+			end, last = t, v
+		}
 	}
-	return
+	var total, seconds float64
+	eachStep(dps, end, func(v, w float64) {
+		total += v * w
+		seconds += w
+	})
+	if seconds == 0 {
+		return last
+	}
+	return total / seconds
 }
 
-func Des(e *State, T miniprofiler.Timer, series *Results, alpha float64, beta float64) *Results {
-	for _, res := range series.Results {
-		sorted := NewSortedSeries(res.Value.Value().(Series))
-		if len(sorted) < 2 {
+func EWMA(e *State, T miniprofiler.Timer, series *Results, alpha float64) (*Results, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("ewma: alpha must be in (0, 1], got %v", alpha)
+	}
+	return reduce(e, T, series, ewma, alpha)
+}
+
+func EWVar(e *State, T miniprofiler.Timer, series *Results, alpha float64) (*Results, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("ewvar: alpha must be in (0, 1], got %v", alpha)
+	}
+	return reduce(e, T, series, ewvar, alpha)
+}
+
+func ewma(dps Series, args ...float64) float64 {
+	mean, _ := ewStats(dps, args[0])
+	return mean
+}
+
+func ewvar(dps Series, args ...float64) float64 {
+	_, variance := ewStats(dps, args[0])
+	return variance
+}
+
+// ewStats returns the exponentially weighted moving average and variance of
+// the non-NaN values of the series in time order, each new value having
+// weight alpha. They are NaN if there are no such values.
+func ewStats(dps Series, alpha float64) (mean, variance float64) {
+	mean, variance = math.NaN(), math.NaN()
+	for _, p := range NewSortedSeries(dps) {
+		if math.IsNaN(p.V) {
 			continue
 		}
-		des := make(Series)
-		s := make([]float64, len(sorted))
-		b := make([]float64, len(sorted))
-		s[0] = sorted[0].V
-		for i := 1; i < len(sorted); i++ {
-			s[i] = alpha*sorted[i].V + (1-alpha)*(s[i-1]+b[i-1])
-			b[i] = beta*(s[i]-s[i-1]) + (1-beta)*b[i-1]
-			des[sorted[i].T] = s[i]
+		if math.IsNaN(mean) {
+			mean, variance = p.V, 0
+			continue
 		}
-		res.Value = des
+		diff := p.V - mean
+		incr := alpha * diff
+		mean += incr
+		variance = (1 - alpha) * (variance + diff*incr)
 	}
-	return series
+	return
 }
 
-func Streak(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
-	return reduce(e, T, series, streak)
+func TrailingNaN(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, trailingNaN)
 }
 
-func streak(dps Series, args ...float64) (a float64) {
-	max := func(a, b int) int {
-		if a > b {
-			return a
-		}
-		return b
+// trailingNaN returns the number of consecutive NaN points at the end of the
+// series.
+func trailingNaN(dps Series, args ...float64) (n float64) {
+	s := NewSortedSeries(dps)
+	for i := len(s) - 1; i >= 0 && math.IsNaN(s[i].V); i-- {
+		n++
 	}
+	return
+}
 
-	series := NewSortedSeries(dps)
+// CUSUM returns the final cumulative sum control statistic of each series for
+// detecting drift away from target by more than slack, either upward ("high")
+// or downward ("low").
+func CUSUM(e *State, T miniprofiler.Timer, series *Results, target, slack float64, direction string) (*Results, error) {
+	var sign float64
+	switch direction {
+	case "high":
+		sign = 1
+	case "low":
+		sign = -1
+	default:
+		return nil, fmt.Errorf("cusum: unknown direction %q, expected high or low", direction)
+	}
+	return reduce(e, T, series, cusum, target, slack, sign)
+}
 
-	current := 0
-	longest := 0
-	for _, p := range series {
-		if p.V != 0 {
-			current++
-		} else {
-			longest = max(current, longest)
-			current = 0
+func cusum(dps Series, args ...float64) (c float64) {
+	target, slack, sign := args[0], args[1], args[2]
+	for _, p := range NewSortedSeries(dps) {
+		if !math.IsNaN(p.V) {
+			c = math.Max(0, c+sign*(p.V-target)-slack)
 		}
 	}
-	longest = max(current, longest)
-	return float64(longest)
+	return
 }
 
-func Dev(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
-	return reduce(e, T, series, dev)
+func Range(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, valueRange)
 }
 
-// dev returns the sample standard deviation of x.
-func dev(dps Series, args ...float64) (d float64) {
-	if len(dps) == 1 {
-		return 0
+// valueRange returns the difference between the largest and smallest non-NaN
+// values of x, or NaN if there are none.
+func valueRange(dps Series, args ...float64) float64 {
+	min, max := math.NaN(), math.NaN()
+	for _, v := range dps {
+		if math.IsNaN(v) {
+			continue
+		}
+		if math.IsNaN(min) || v < min {
+			min = v
+		}
+		if math.IsNaN(max) || v > max {
+			max = v
+		}
 	}
-	a := avg(dps)
+	return max - min
+}
+
+func GeoMean(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, geomean)
+}
+
+// geomean returns the geometric mean of x, or NaN if any value is not
+// positive.
+func geomean(dps Series, args ...float64) float64 {
+	var logs float64
 	for _, v := range dps {
-		d += math.Pow(float64(v)-a, 2)
+		if !(v > 0) {
+			return math.NaN()
+		}
+		logs += math.Log(v)
 	}
-	d /= float64(len(dps) - 1)
-	return math.Sqrt(d)
+	return math.Exp(logs / float64(len(dps)))
 }
 
 func Length(e *State, T miniprofiler.Timer, series *Results) (*Results, error) {
@@ -928,6 +3595,175 @@ func forecast_lr(dps Series, args ...float64) float64 {
 	return s.Seconds()
 }
 
+func R2(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
+	return reduce(e, T, series, r2)
+}
+
+// r2 returns the coefficient of determination of the linear regression of the
+// series against time, or NaN for fewer than three points.
+func r2(dps Series, args ...float64) float64 {
+	if len(dps) < 3 {
+		return math.NaN()
+	}
+	s := NewSortedSeries(dps)
+	var x, y []float64
+	for _, p := range s {
+		// Offset times from the first point to keep the sums precise.
+		x = append(x, p.T.Sub(s[0].T).Seconds())
+		y = append(y, p.V)
+	}
+	_, _, rsquared, _, _, _ := stats.LinearRegression(x, y)
+	return rsquared
+}
+
+func GrowsFasterThan(e *State, T miniprofiler.Timer, series *Results, perHour float64) (r *Results, err error) {
+	return reduce(e, T, series, growsFasterThan, perHour)
+}
+
+// growsFasterThan returns 1 if the slope of the linear regression of the
+// series exceeds args[0] per hour, otherwise 0, or NaN for fewer than two
+// points.
+func growsFasterThan(dps Series, args ...float64) float64 {
+	slope := lrSlope(dps)
+	switch {
+	case math.IsNaN(slope):
+		return math.NaN()
+	case slope*time.Hour.Seconds() > args[0]:
+		return 1
+	}
+	return 0
+}
+
+// lrSlope returns the per-second slope of the linear regression of the series
+// against time, or NaN for fewer than two points.
+func lrSlope(dps Series) float64 {
+	slope, _, _, _ := lrFit(dps)
+	return slope
+}
+
+// lrFit returns the linear regression of the series against the number of
+// seconds since start, its first point. The results are NaN for fewer than
+// two points.
+func lrFit(dps Series) (slope, intercept, rsquared float64, start time.Time) {
+	if len(dps) < 2 {
+		return math.NaN(), math.NaN(), math.NaN(), start
+	}
+	s := NewSortedSeries(dps)
+	var x, y []float64
+	for _, p := range s {
+		x = append(x, p.T.Sub(s[0].T).Seconds())
+		y = append(y, p.V)
+	}
+	slope, intercept, rsquared, _, _, _ = stats.LinearRegression(x, y)
+	return slope, intercept, rsquared, s[0].T
+}
+
+func Acceleration(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
+	return reduce(e, T, series, acceleration)
+}
+
+// acceleration returns the second derivative, in units per second squared, of
+// the least-squares quadratic fit of the series against time, or NaN for fewer
+// than three distinct times.
+func acceleration(dps Series, args ...float64) float64 {
+	if len(dps) < 3 {
+		return math.NaN()
+	}
+	// Fit y = a + bx + cx² about the mean time to keep the sums precise.
+	var mean float64
+	for t := range dps {
+		mean += float64(t.Unix())
+	}
+	mean /= float64(len(dps))
+	var n, sx, sx2, sx3, sx4, sy, sxy, sx2y float64
+	for t, y := range dps {
+		x := float64(t.Unix()) - mean
+		n++
+		sx += x
+		sx2 += x * x
+		sx3 += x * x * x
+		sx4 += x * x * x * x
+		sy += y
+		sxy += x * y
+		sx2y += x * x * y
+	}
+	det := func(a, b, c, d, e, f, g, h, i float64) float64 {
+		return a*(e*i-f*h) - b*(d*i-f*g) + c*(d*h-e*g)
+	}
+	d := det(n, sx, sx2, sx, sx2, sx3, sx2, sx3, sx4)
+	if d == 0 {
+		return math.NaN()
+	}
+	c := det(n, sx, sy, sx, sx2, sxy, sx2, sx3, sx2y) / d
+	return 2 * c
+}
+
+// maxTheilSenPoints caps the number of points theilsen compares pairwise.
+// Longer series are sampled evenly down to this size.
+const maxTheilSenPoints = 500
+
+func TheilSen(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
+	return reduce(e, T, series, theilSen)
+}
+
+// theilSen returns the Theil-Sen estimate of the per-second trend of the
+// series: the median of the slopes between every pair of non-NaN points. It
+// returns NaN for fewer than two points.
+func theilSen(dps Series, args ...float64) float64 {
+	var s SortableSeries
+	for _, p := range NewSortedSeries(dps) {
+		if !math.IsNaN(p.V) {
+			s = append(s, p)
+		}
+	}
+	if len(s) > maxTheilSenPoints {
+		sampled := make(SortableSeries, maxTheilSenPoints)
+		for i := range sampled {
+			sampled[i] = s[i*(len(s)-1)/(maxTheilSenPoints-1)]
+		}
+		s = sampled
+	}
+	var slopes []float64
+	for i := range s {
+		for j := i + 1; j < len(s); j++ {
+			slopes = append(slopes, (s[j].V-s[i].V)/s[j].T.Sub(s[i].T).Seconds())
+		}
+	}
+	if len(slopes) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(slopes)
+	m := len(slopes) / 2
+	if len(slopes)%2 == 0 {
+		return (slopes[m-1] + slopes[m]) / 2
+	}
+	return slopes[m]
+}
+
+// minTimeToR2 is the coefficient of determination below which time_to
+// considers a linear fit too noisy to extrapolate.
+const minTimeToR2 = 0.5
+
+func TimeTo(e *State, T miniprofiler.Timer, series *Results, target float64) (r *Results, err error) {
+	return reduce(e, T, series, timeTo, target, float64(e.now.Unix()))
+}
+
+// timeTo returns the number of seconds from now until the linear trend of the
+// series reaches target, 0 if it is there now, or +Inf if the trend is moving
+// away from it. It returns NaN if the trend is flat or the fit is poor.
+func timeTo(dps Series, args ...float64) float64 {
+	target, now := args[0], time.Unix(int64(args[1]), 0)
+	slope, intercept, rsquared, start := lrFit(dps)
+	if math.IsNaN(slope) || slope == 0 || rsquared < minTimeToR2 {
+		return math.NaN()
+	}
+	gap := target - (intercept + slope*now.Sub(start).Seconds())
+	if gap*slope < 0 {
+		return math.Inf(1)
+	}
+	return gap / slope
+}
+
 func Percentile(e *State, T miniprofiler.Timer, series *Results, p float64) (r *Results, err error) {
 	return reduce(e, T, series, percentile, p)
 }
@@ -964,6 +3800,126 @@ func percentile(dps Series, args ...float64) (a float64) {
 	return x[int(i)]
 }
 
+func PRatio(e *State, T miniprofiler.Timer, series *Results, pHigh, pLow float64) (r *Results, err error) {
+	return reduce(e, T, series, pRatio, pHigh, pLow)
+}
+
+// pRatio returns the pHigh-th percentile of the series divided by its pLow-th
+// percentile, a measure of how heavy the tail is. It is NaN if the pLow-th
+// percentile is zero.
+func pRatio(dps Series, args ...float64) float64 {
+	lo := percentile(dps, args[1])
+	if lo == 0 {
+		return math.NaN()
+	}
+	return percentile(dps, args[0]) / lo
+}
+
+func DevFromQ(e *State, T miniprofiler.Timer, series *Results, p float64) (r *Results, err error) {
+	return reduce(e, T, series, devFromQ, p)
+}
+
+// devFromQ returns the difference between the last value of the series and
+// its p-th percentile, so it is positive when the latest value exceeds it.
+func devFromQ(dps Series, args ...float64) float64 {
+	return last(dps) - percentile(dps, args...)
+}
+
+func IQR(e *State, T miniprofiler.Timer, series *Results) (r *Results, err error) {
+	return reduce(e, T, series, iqr)
+}
+
+// iqr returns the interquartile range of the non-NaN values of the series, or
+// NaN if there are none.
+func iqr(dps Series, args ...float64) float64 {
+	q1, q3 := quartiles(dps)
+	return q3 - q1
+}
+
+func Outliers(e *State, T miniprofiler.Timer, series *Results, k float64) (r *Results, err error) {
+	return reduce(e, T, series, outliers, k)
+}
+
+// outliers returns the number of points outside the Tukey fences of the
+// series, Q1 - k*IQR and Q3 + k*IQR. k is conventionally 1.5.
+func outliers(dps Series, args ...float64) (n float64) {
+	q1, q3 := quartiles(dps)
+	lo, hi := q1-args[0]*(q3-q1), q3+args[0]*(q3-q1)
+	for _, v := range dps {
+		if v < lo || v > hi {
+			n++
+		}
+	}
+	return
+}
+
+// quartiles returns the 25th and 75th percentiles of the non-NaN values of
+// the series, or NaN if there are none.
+func quartiles(dps Series) (q1, q3 float64) {
+	s := make(Series, len(dps))
+	for t, v := range dps {
+		if !math.IsNaN(v) {
+			s[t] = v
+		}
+	}
+	if len(s) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	return percentile(s, .25), percentile(s, .75)
+}
+
+// Pick returns the single result with the largest ("max") or smallest ("min")
+// value, keeping its group. NaN values are ignored, and ties go to the group
+// that sorts first.
+func Pick(e *State, T miniprofiler.Timer, series *Results, rule string) (*Results, error) {
+	return pick("pick", series, rule)
+}
+
+// WorstGroup is like Pick, but also labels the chosen result with its tags, as
+// in "host=ny-web01", by adding them as a computation.
+func WorstGroup(e *State, T miniprofiler.Timer, series *Results, rule string) (*Results, error) {
+	r, err := pick("worst_group", series, rule)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		res.AddComputation(res.Group.Tags(), res.Value)
+	}
+	return r, nil
+}
+
+func pick(fname string, series *Results, rule string) (*Results, error) {
+	var better func(a, b float64) bool
+	switch rule {
+	case "max":
+		better = func(a, b float64) bool { return a > b }
+	case "min":
+		better = func(a, b float64) bool { return a < b }
+	default:
+		return nil, fmt.Errorf("%s: unknown rule %q, expected max or min", fname, rule)
+	}
+	var best *Result
+	for _, res := range series.Results {
+		v := float64(res.Value.(Number))
+		if math.IsNaN(v) {
+			continue
+		}
+		if best != nil {
+			bv := float64(best.Value.(Number))
+			if better(bv, v) || bv == v && best.Group.String() < res.Group.String() {
+				continue
+			}
+		}
+		best = res
+	}
+	r := *series
+	r.Results = nil
+	if best != nil {
+		r.Results = ResultSlice{best}
+	}
+	return &r, nil
+}
+
 func Rename(e *State, T miniprofiler.Timer, series *Results, s string) (*Results, error) {
 	for _, section := range strings.Split(s, ",") {
 		kv := strings.Split(section, "=")
@@ -987,6 +3943,65 @@ func Rename(e *State, T miniprofiler.Timer, series *Results, s string) (*Results
 	return series, nil
 }
 
+// Bucketize rounds each non-NaN point of each group down to a multiple of
+// size, and returns the number of points in each of these buckets as a group
+// with an additional bucket tag holding the bucket's lower bound.
+func Bucketize(e *State, T miniprofiler.Timer, series *Results, size float64) (*Results, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("bucketize: bucket size must be positive, got %v", size)
+	}
+	r := *series
+	r.Results = nil
+	for _, res := range series.Results {
+		if _, ok := res.Group["bucket"]; ok {
+			return nil, fmt.Errorf("bucketize: bucket already in group")
+		}
+		counts := make(map[float64]int)
+		for _, v := range res.Value.(Series) {
+			if !math.IsNaN(v) {
+				counts[math.Floor(v/size)*size]++
+			}
+		}
+		var buckets []float64
+		for b := range counts {
+			buckets = append(buckets, b)
+		}
+		sort.Float64s(buckets)
+		for _, b := range buckets {
+			g := res.Group.Copy()
+			g["bucket"] = strconv.FormatFloat(b, 'f', -1, 64)
+			r.Results = append(r.Results, &Result{
+				Value: Number(counts[b]),
+				Group: g,
+			})
+		}
+	}
+	return &r, nil
+}
+
+// Select returns the value of the group whose tagk equals tagv as a scalar,
+// or NaN if no group matches. More than one matching group is an error, since
+// the result would depend on the order of the groups. It is named select,
+// not lookup, because the conf package already defines lookup() for lookup
+// tables, and it takes a reduced number, such as avg(q(..)), rather than a
+// query and duration so that any reduction can be used.
+func Select(e *State, T miniprofiler.Timer, series *Results, tagk, tagv string) (*Results, error) {
+	var found *Result
+	for _, res := range series.Results {
+		if v, ok := res.Group[tagk]; !ok || v != tagv {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("select: multiple groups match %s=%s", tagk, tagv)
+		}
+		found = res
+	}
+	if found == nil {
+		return wrap(math.NaN()), nil
+	}
+	return wrap(float64(found.Value.(Number))), nil
+}
+
 func Ungroup(e *State, T miniprofiler.Timer, d *Results) (*Results, error) {
 	if len(d.Results) != 1 {
 		return nil, fmt.Errorf("ungroup: requires exactly one group")
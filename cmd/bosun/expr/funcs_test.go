@@ -0,0 +1,2443 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/cache"
+	"bosun.org/opentsdb"
+)
+
+// testNow is the evaluation time used by all function tests.
+var testNow = time.Unix(1420070400, 0).UTC()
+
+// testContext is an in-memory OpenTSDB context. It serves the responses for a
+// query's metric, dropping points outside of the requested time range, and
+// records every request it receives.
+type testContext struct {
+	responses map[string]opentsdb.ResponseSet
+	requests  []*opentsdb.Request
+}
+
+func (c *testContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	c.requests = append(c.requests, r)
+	start, err := opentsdb.ParseTime(r.Start)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Unix(math.MaxInt32, 0)
+	if r.End != nil {
+		if end, err = opentsdb.ParseTime(r.End); err != nil {
+			return nil, err
+		}
+	}
+	var rs opentsdb.ResponseSet
+	for _, q := range r.Queries {
+		for _, resp := range c.responses[q.Metric] {
+			resp = resp.Copy()
+			for k := range resp.DPS {
+				i, _ := strconv.ParseInt(k, 10, 64)
+				if i < start.Unix() || i > end.Unix() {
+					delete(resp.DPS, k)
+				}
+			}
+			rs = append(rs, resp)
+		}
+	}
+	return rs, nil
+}
+
+// response builds a response for the tags (formatted as "k=v,k=v") whose
+// values are spaced step seconds apart, ending step seconds before testNow.
+func response(tags string, step int64, values ...float64) *opentsdb.Response {
+	r := &opentsdb.Response{
+		DPS: make(map[string]opentsdb.Point),
+	}
+	if tags != "" {
+		r.Tags, _ = opentsdb.ParseTags(tags)
+	}
+	ts := testNow.Unix() - step*int64(len(values))
+	for _, v := range values {
+		r.DPS[strconv.FormatInt(ts, 10)] = opentsdb.Point(v)
+		ts += step
+	}
+	return r
+}
+
+// shifted returns a copy of r with its points moved d into the past, merged
+// with the points of the responses in also.
+func shifted(r *opentsdb.Response, d time.Duration, also ...*opentsdb.Response) *opentsdb.Response {
+	s := r.Copy()
+	s.DPS = make(map[string]opentsdb.Point)
+	for k, v := range r.DPS {
+		i, _ := strconv.ParseInt(k, 10, 64)
+		s.DPS[strconv.FormatInt(i-int64(d.Seconds()), 10)] = v
+	}
+	for _, a := range also {
+		for k, v := range a.DPS {
+			s.DPS[k] = v
+		}
+	}
+	return s
+}
+
+func testExpr(input string, c opentsdb.Context) (*Results, error) {
+	e, err := New(input, TSDB)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := e.Execute(c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil)
+	return r, err
+}
+
+// resultValues returns the float value of each result keyed by its group.
+func resultValues(r *Results) map[string]float64 {
+	m := make(map[string]float64)
+	for _, res := range r.Results {
+		var v float64
+		switch t := res.Value.(type) {
+		case Number:
+			v = float64(t)
+		case Scalar:
+			v = float64(t)
+		}
+		m[res.Group.String()] = v
+	}
+	return m
+}
+
+type funcTest struct {
+	expr   string
+	output map[string]float64
+	err    string
+}
+
+// testFuncs evaluates each test against c, checking either its grouped
+// output or that the error contains the expected text.
+func testFuncs(t *testing.T, c opentsdb.Context, tests []funcTest) {
+	for _, ft := range tests {
+		r, err := testExpr(ft.expr, c)
+		if ft.err != "" {
+			if err == nil || !strings.Contains(err.Error(), ft.err) {
+				t.Errorf("%s: expected error containing %q, got %v", ft.expr, ft.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", ft.expr, err)
+			continue
+		}
+		got := resultValues(r)
+		if len(got) != len(ft.output) {
+			t.Errorf("%s: expected %v, got %v", ft.expr, ft.output, got)
+			continue
+		}
+		for g, v := range ft.output {
+			gv, ok := got[g]
+			switch {
+			case !ok:
+				t.Errorf("%s: missing group %s", ft.expr, g)
+			case math.IsNaN(v) && math.IsNaN(gv):
+			case math.IsInf(v, 0) && v == gv:
+			case math.IsNaN(v) != math.IsNaN(gv), math.Abs(v-gv) > 1e-9:
+				t.Errorf("%s: group %s: expected %v, got %v", ft.expr, g, v, gv)
+			}
+		}
+	}
+}
+
+func TestReduce(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3, 10),
+			response("host=b", 60, 4, 4, 4, 4),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `reduce(q("sum:m{host=*}", "1h", ""), "avg")`, output: map[string]float64{"{host=a}": 4, "{host=b}": 4}},
+		{expr: `reduce(q("sum:m{host=*}", "1h", ""), "min")`, output: map[string]float64{"{host=a}": 1, "{host=b}": 4}},
+		{expr: `reduce(q("sum:m{host=*}", "1h", ""), "max")`, output: map[string]float64{"{host=a}": 10, "{host=b}": 4}},
+		{expr: `reduce(q("sum:m{host=*}", "1h", ""), "sum")`, output: map[string]float64{"{host=a}": 16, "{host=b}": 16}},
+		{expr: `reduce(q("sum:m{host=*}", "1h", ""), "last")`, output: map[string]float64{"{host=a}": 10, "{host=b}": 4}},
+		{expr: `reduce(q("sum:m{host=*}", "1h", ""), "mean")`, err: `unknown aggregator "mean", expected one of: avg, last, max, min, sum`},
+	})
+}
+
+func TestSelect(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3),
+			response("host=b", 60, 4, 5, 6),
+		},
+		"dc": {
+			response("host=a,dc=x", 60, 1),
+			response("host=a,dc=y", 60, 2),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `select(avg(q("sum:m{host=*}", "1h", "")), "host", "b")`, output: map[string]float64{"{}": 5}},
+		{expr: `select(avg(q("sum:m{host=*}", "1h", "")), "host", "c")`, output: map[string]float64{"{}": math.NaN()}},
+		{expr: `select(avg(q("sum:m{host=*}", "1h", "")), "host", "a") * 2`, output: map[string]float64{"{}": 4}},
+		{expr: `select(avg(q("sum:dc{host=*,dc=*}", "1h", "")), "host", "a")`, err: "select: multiple groups match host=a"},
+		{expr: `select(avg(q("sum:dc{host=*,dc=*}", "1h", "")), "dc", "y")`, output: map[string]float64{"{}": 2}},
+	})
+}
+
+func TestPctChange(t *testing.T) {
+	const day = 24 * time.Hour
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			shifted(response("host=a", 60, 100, 100), day, response("host=a", 60, 150, 150)),
+			shifted(response("host=b", 60, 100, 100), day, response("host=b", 60, 50, 50)),
+			shifted(response("host=c", 60, 0, 0), day, response("host=c", 60, 10, 10)),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `pct_change("sum:m{host=*}", "1h", "1d")`, output: map[string]float64{
+			"{host=a}": 50,
+			"{host=b}": -50,
+			"{host=c}": math.NaN(),
+		}},
+		{expr: `pct_change("sum:m{host=*}", "1h", "bad")`, err: "invalid duration"},
+	})
+}
+
+func TestMissing(t *testing.T) {
+	full := make([]float64, 60)
+	half := make([]float64, 30)
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=full", 60, full...),
+			response("host=half", 120, half...),
+			response("host=empty", 60),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `missing("sum:m{host=*}", "1h", "1m")`, output: map[string]float64{
+			"{host=full}":  0,
+			"{host=half}":  0.5,
+			"{host=empty}": 1,
+		}},
+		{expr: `missing("sum:m{host=*}", "1h", "2h")`, err: "interval must be positive"},
+	})
+}
+
+func TestTExtreme(t *testing.T) {
+	nan := math.NaN()
+	// Points are at testNow-300, -240, -180, -120 and -60.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=peak", 60, 1, 2, 9, 2, 1),
+			response("host=tie", 60, 5, 0, 5, 0, 5),
+			response("host=nan", 60, nan, nan),
+		},
+	}}
+	ts := func(ago int64) float64 { return float64(testNow.Unix() - ago) }
+	testFuncs(t, c, []funcTest{
+		{expr: `tmax(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=peak}": ts(180),
+			"{host=tie}":  ts(300),
+			"{host=nan}":  nan,
+		}},
+		{expr: `tmin(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=peak}": ts(300),
+			"{host=tie}":  ts(240),
+			"{host=nan}":  nan,
+		}},
+	})
+}
+
+func TestBaseline(t *testing.T) {
+	const day = 24 * time.Hour
+	// Today's window runs hot against a baseline of 10 and 14 on the two
+	// prior days; three days ago is outside the baseline.
+	periodic := func(tags string, today, yesterday, twoDays, threeDays float64) *opentsdb.Response {
+		return shifted(response(tags, 600, threeDays, threeDays), 3*day,
+			shifted(response(tags, 600, twoDays, twoDays), 2*day),
+			shifted(response(tags, 600, yesterday, yesterday), day),
+			response(tags, 600, today, today),
+		)
+	}
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			periodic("host=a", 20, 10, 14, 100),
+			periodic("host=b", 5, 5, 5, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `baseline("sum:m{host=*}", "1h", "1d", 2)`, output: map[string]float64{"{host=a}": 12, "{host=b}": 5}},
+		{expr: `baseline("sum:m{host=*}", "1h", "1d", 3)`, output: map[string]float64{"{host=a}": 124.0 / 3, "{host=b}": 5}},
+		{expr: `avg(q("sum:m{host=*}", "1h", "")) / baseline("sum:m{host=*}", "1h", "1d", 2)`, output: map[string]float64{"{host=a}": 20.0 / 12, "{host=b}": 1}},
+		{expr: `baseline("sum:m{host=*}", "1h", "1d", 0)`, err: "num out of bounds"},
+	})
+}
+
+func TestDebugSeries(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3),
+		},
+	}}
+	r, err := testExpr(`avg(debug_series("sum:m{host=*}", "1h"))`, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 1 || r.Results[0].Value != Number(2) {
+		t.Fatalf("unexpected results: %v", resultValues(r))
+	}
+	b, err := json.Marshal(r.Results[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Computations []struct {
+			Text  string
+			Value json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// The reduction adds its own computation after the debug one.
+	if len(decoded.Computations) == 0 {
+		t.Fatalf("expected computations, got %s", b)
+	}
+	comp := decoded.Computations[0]
+	if want := `debug_series("sum:m{host=a}", "1h")`; comp.Text != want {
+		t.Errorf("expected text %s, got %s", want, comp.Text)
+	}
+	var got map[string]float64
+	if err := json.Unmarshal(comp.Value, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]float64)
+	for k, v := range c.responses["m"][0].DPS {
+		want[k] = float64(v)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected series %v, got %v", want, got)
+	}
+}
+
+func TestErrOnEmpty(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3),
+		},
+	}}
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{`avg(q("sum:m{host=*}", "1h", ""))`, ""},
+		{`avg(q("sum:empty{host=*}", "1h", ""))`, "q: query returned no data: sum:empty{host=*}"},
+	}
+	for _, test := range tests {
+		e, err := New(test.expr, TSDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.ErrOnEmpty = true
+		r, _, err := e.Execute(c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.expr, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+		} else if len(r.Results) != 1 {
+			t.Errorf("%s: expected one result, got %v", test.expr, resultValues(r))
+		}
+	}
+	// Without the flag an empty query is not an error.
+	if r, err := testExpr(`avg(q("sum:empty{host=*}", "1h", ""))`, c); err != nil || len(r.Results) != 0 {
+		t.Errorf("expected empty results, got %v, %v", r, err)
+	}
+}
+
+func TestUnionScalar(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3),
+			response("host=b", 60, 4, 5, 6),
+		},
+		"total": {
+			response("", 60, 10, 10),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `avg(q("sum:m{host=*}", "1h", "")) - 1`, output: map[string]float64{"{host=a}": 1, "{host=b}": 4}},
+		{expr: `1 - avg(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": -1, "{host=b}": -4}},
+		{expr: `avg(q("sum:m{host=*}", "1h", "")) - count("sum:m{host=*}", "1h", "")`, output: map[string]float64{"{host=a}": 0, "{host=b}": 3}},
+		{expr: `avg(q("sum:total", "1h", "")) - avg(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": 8, "{host=b}": 5}},
+		{expr: `avg(q("sum:m{host=*}", "1h", "")) - avg(q("sum:total", "1h", ""))`, output: map[string]float64{"{host=a}": -8, "{host=b}": -5}},
+	})
+	// A NaN scalar still applies per group and keeps the grouped type.
+	nan := `select(avg(q("sum:m{host=*}", "1h", "")), "host", "none")`
+	for _, input := range []string{
+		`avg(q("sum:m{host=*}", "1h", "")) - ` + nan,
+		nan + ` - avg(q("sum:m{host=*}", "1h", ""))`,
+	} {
+		r, err := testExpr(input, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 2 {
+			t.Fatalf("%s: expected two groups, got %v", input, resultValues(r))
+		}
+		for _, res := range r.Results {
+			if n, ok := res.Value.(Number); !ok || !math.IsNaN(float64(n)) {
+				t.Errorf("%s: group %s: expected Number NaN, got %#v", input, res.Group, res.Value)
+			}
+		}
+	}
+}
+
+func TestUnionBroadcast(t *testing.T) {
+	hosts := []string{"a", "b", "c", "d", "e"}
+	var rs opentsdb.ResponseSet
+	want := make(map[string]float64)
+	for i, h := range hosts {
+		rs = append(rs, response("host="+h, 60, float64(i)))
+		want["{host="+h+"}"] = float64(i) * 1.5
+	}
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{"m": rs}}
+	testFuncs(t, c, []funcTest{
+		{expr: `avg(q("sum:m{host=*}", "1h", "")) * 1.5`, output: want},
+		{expr: `1.5 * avg(q("sum:m{host=*}", "1h", ""))`, output: want},
+		{expr: `(avg(q("sum:m{host=*}", "1h", "")) * 3) / 2`, output: want},
+	})
+}
+
+func TestCoalesce(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"primary": {
+			response("host=a", 60, 1),
+			response("host=b", 60, nan),
+			response("host=c", 60, nan),
+			response("host=d", 60, 4),
+		},
+		"secondary": {
+			response("host=a", 60, 10),
+			response("host=b", 60, 20),
+			response("host=e", 60, 50),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `coalesce(avg(q("sum:primary{host=*}", "1h", "")), avg(q("sum:secondary{host=*}", "1h", "")))`, output: map[string]float64{
+			"{host=a}": 1,
+			"{host=b}": 20,
+			"{host=c}": nan,
+			"{host=d}": 4,
+			"{host=e}": 50,
+		}},
+	})
+}
+
+func TestIncrease(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=steady", 60, 100, 110, 125, 140),
+			response("host=reset", 60, 100, 120, 5, 30),
+			response("host=flat", 60, 7, 7, 7),
+			response("host=single", 60, 9),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `increase("sum:m{host=*}", "1h", "")`, output: map[string]float64{
+			"{host=steady}": 40,
+			"{host=reset}":  50,
+			"{host=flat}":   0,
+			"{host=single}": 0,
+		}},
+	})
+}
+
+func TestConvert(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 5e9),
+			response("host=b", 60, 1<<30),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `scale(avg(q("sum:m{host=*}", "1h", "")), 0.5)`, output: map[string]float64{"{host=a}": 2.5e9, "{host=b}": 1 << 29}},
+		{expr: `convert(avg(q("sum:m{host=*}", "1h", "")), "bytes", "GB")`, output: map[string]float64{"{host=a}": 5, "{host=b}": 1.073741824}},
+		{expr: `convert(avg(q("sum:m{host=*}", "1h", "")), "bytes", "GiB")`, output: map[string]float64{"{host=a}": 5e9 / (1 << 30), "{host=b}": 1}},
+		{expr: `convert(avg(q("sum:m{host=*}", "1h", "")), "bytes", "s")`, err: "cannot convert bytes to s"},
+		{expr: `convert(avg(q("sum:m{host=*}", "1h", "")), "bytes", "furlongs")`, err: "expected two units of the same kind from: GB, GiB,"},
+	})
+}
+
+func TestWAvg(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"latency": {
+			response("host=a", 60, 10, 10),
+			response("host=b", 60, 40),
+			response("host=c", 60, 1000),
+		},
+		"requests": {
+			response("host=a", 60, 2, 4),
+			response("host=b", 60, 1),
+			response("host=d", 60, 50),
+		},
+		"idle": {
+			response("host=a", 60, 0),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		// host=c has no weight and host=d no value, so only a and b count.
+		{expr: `wavg("sum:latency{host=*}", "sum:requests{host=*}", "1h")`, output: map[string]float64{"{}": (10*3 + 40*1) / 4.0}},
+		{expr: `wavg("sum:latency{host=*}", "sum:idle{host=*}", "1h")`, output: map[string]float64{"{}": math.NaN()}},
+	})
+}
+
+func TestGroupSets(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"expected": {
+			response("host=a", 60, 1),
+			response("host=b", 60, 2),
+			response("host=c", 60, 3),
+		},
+		"reporting": {
+			response("host=b", 60, 20),
+			response("host=c", 60, 30),
+			response("host=d", 60, 40),
+		},
+		"other": {
+			response("host=x", 60, 9),
+		},
+	}}
+	const (
+		expected  = `avg(q("sum:expected{host=*}", "1h", ""))`
+		reporting = `avg(q("sum:reporting{host=*}", "1h", ""))`
+		other     = `avg(q("sum:other{host=*}", "1h", ""))`
+	)
+	testFuncs(t, c, []funcTest{
+		{expr: `group_diff(` + expected + `, ` + reporting + `)`, output: map[string]float64{"{host=a}": 1}},
+		{expr: `group_intersect(` + expected + `, ` + reporting + `)`, output: map[string]float64{"{host=b}": 2, "{host=c}": 3}},
+		{expr: `group_union(` + expected + `, ` + reporting + `)`, output: map[string]float64{"{host=a}": 1, "{host=b}": 2, "{host=c}": 3, "{host=d}": 40}},
+		{expr: `group_diff(` + expected + `, ` + other + `)`, output: map[string]float64{"{host=a}": 1, "{host=b}": 2, "{host=c}": 3}},
+		{expr: `group_intersect(` + expected + `, ` + other + `)`, output: map[string]float64{}},
+		{expr: `group_union(` + expected + `, ` + other + `)`, output: map[string]float64{"{host=a}": 1, "{host=b}": 2, "{host=c}": 3, "{host=x}": 9}},
+	})
+}
+
+func TestPctAbove(t *testing.T) {
+	nan := math.NaN()
+	// With 60s steps and the last point 60s before testNow, every point
+	// covers a minute, except that the uneven series has a 3m gap.
+	uneven := response("host=uneven", 60, 1, 10)
+	uneven.DPS[strconv.FormatInt(testNow.Unix()-300, 10)] = 10
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=cross", 60, 1, 10, 1, 10, 10, 1),
+			response("host=nan", 60, 10, nan, nan, 1),
+			uneven,
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `pct_above("sum:m{host=*}", "1h", 5, "count")`, output: map[string]float64{
+			"{host=cross}":  0.5,
+			"{host=nan}":    0.5,
+			"{host=uneven}": 2.0 / 3,
+		}},
+		{expr: `pct_above("sum:m{host=*}", "1h", 5, "time")`, output: map[string]float64{
+			"{host=cross}":  0.5,
+			"{host=nan}":    0.5,
+			"{host=uneven}": 0.8,
+		}},
+		{expr: `pct_above("sum:m{host=*}", "1h", 5, "points")`, err: `unknown mode "points"`},
+	})
+}
+
+func TestMedianFilter(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=spike", 60, 1, 1, 1, 100, 1, 1, 1),
+			response("host=shift", 60, 1, 1, 1, 5, 5, 5, 5),
+		},
+	}}
+	for _, window := range []string{"3", "2m"} {
+		testFuncs(t, c, []funcTest{
+			{expr: `max(median_filter("sum:m{host=*}", "1h", "` + window + `"))`, output: map[string]float64{"{host=spike}": 1, "{host=shift}": 5}},
+			{expr: `last(median_filter("sum:m{host=*}", "1h", "` + window + `"))`, output: map[string]float64{"{host=spike}": 1, "{host=shift}": 5}},
+			{expr: `sum(median_filter("sum:m{host=*}", "1h", "` + window + `"))`, output: map[string]float64{"{host=spike}": 7, "{host=shift}": 23}},
+		})
+	}
+	testFuncs(t, c, []funcTest{
+		{expr: `median_filter("sum:m{host=*}", "1h", "4")`, err: "positive odd number"},
+		{expr: `median_filter("sum:m{host=*}", "1h", "x")`, err: "point count or a duration"},
+	})
+}
+
+func TestNthLast(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3, 4),
+			response("host=nan", 60, 1, 2, nan, 3, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `nth_last("sum:m{host=*}", "1h", 0)`, output: map[string]float64{"{host=a}": 4, "{host=nan}": 3}},
+		{expr: `nth_last("sum:m{host=*}", "1h", 0) == last(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": 1, "{host=nan}": nan}},
+		{expr: `nth_last("sum:m{host=*}", "1h", 1)`, output: map[string]float64{"{host=a}": 3, "{host=nan}": 2}},
+		{expr: `nth_last("sum:m{host=*}", "1h", 3)`, output: map[string]float64{"{host=a}": 1, "{host=nan}": nan}},
+		{expr: `nth_last("sum:m{host=*}", "1h", 10)`, output: map[string]float64{"{host=a}": nan, "{host=nan}": nan}},
+		{expr: `nth_last("sum:m{host=*}", "1h", -1)`, output: map[string]float64{"{host=a}": nan, "{host=nan}": nan}},
+		{expr: `nth_last("sum:m{host=*}", "0h", 1)`, err: `nth_last: duration must be positive, got "0h"`},
+	})
+}
+
+func TestChainedComparison(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=low", 60, 5),
+			response("host=mid", 60, 15),
+			response("host=high", 60, 25),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `10 < avg(q("sum:m{host=*}", "1h", "")) < 20`, output: map[string]float64{
+			"{host=low}":  0,
+			"{host=mid}":  1,
+			"{host=high}": 0,
+		}},
+	})
+	// The middle operand is shared by both comparisons.
+	if len(c.requests) != 1 {
+		t.Errorf("expected 1 query, got %d", len(c.requests))
+	}
+}
+
+func TestGeoMean(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 3, 9),
+			response("host=b", 60, 1.1, 1.2, 0.9),
+			response("host=zero", 60, 4, 0, 4),
+			response("host=neg", 60, 4, -1),
+			response("host=nan", 60, 4, math.NaN()),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `geomean(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=a}":    3,
+			"{host=b}":    math.Cbrt(1.1 * 1.2 * 0.9),
+			"{host=zero}": math.NaN(),
+			"{host=neg}":  math.NaN(),
+			"{host=nan}":  math.NaN(),
+		}},
+	})
+}
+
+func TestRateWrap(t *testing.T) {
+	const max = 1 << 32
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=wrap", 60, max-296, max-96, 100, 300),
+			response("host=reset", 60, 1e6, 2e6, 50, 250),
+			response("host=steady", 60, 0, 600),
+			response("host=single", 60, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `rate_wrap("sum:m{host=*}", "1h", 4294967296)`, output: map[string]float64{
+			"{host=wrap}":   (200 + 196 + 200) / 180.0,
+			"{host=reset}":  (1e6 + 50 + 200) / 180.0,
+			"{host=steady}": 10,
+			"{host=single}": math.NaN(),
+		}},
+	})
+}
+
+func TestSeverity(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 10),
+			response("host=b", 60, 50),
+			response("host=c", 60, 80),
+			response("host=d", 60, 90),
+			response("host=e", 60, 95),
+			response("host=nan", 60, math.NaN()),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `severity(avg(q("sum:m{host=*}", "1h", "")), 80, 90, "high")`, output: map[string]float64{
+			"{host=a}":   0,
+			"{host=b}":   0,
+			"{host=c}":   1,
+			"{host=d}":   2,
+			"{host=e}":   2,
+			"{host=nan}": math.NaN(),
+		}},
+		{expr: `severity(avg(q("sum:m{host=*}", "1h", "")), 50, 10, "low")`, output: map[string]float64{
+			"{host=a}":   2,
+			"{host=b}":   1,
+			"{host=c}":   0,
+			"{host=d}":   0,
+			"{host=e}":   0,
+			"{host=nan}": math.NaN(),
+		}},
+		{expr: `severity(avg(q("sum:m{host=*}", "1h", "")), 50, 10, "up")`, err: `unknown direction "up"`},
+	})
+}
+
+func TestRange(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 3, 9, -2, 4),
+			response("host=flat", 60, 5, 5),
+			response("host=nan", 60, nan, 7, nan, 1),
+			response("host=allnan", 60, nan, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `range(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=a}":      11,
+			"{host=flat}":   0,
+			"{host=nan}":    6,
+			"{host=allnan}": nan,
+		}},
+	})
+	if len(c.requests) != 1 {
+		t.Errorf("expected 1 query, got %d", len(c.requests))
+	}
+	c = &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": c.responses["m"][:2],
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `range(q("sum:m{host=*}", "1h", "")) == max(q("sum:m{host=*}", "1h", "")) - min(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": 1, "{host=flat}": 1}},
+	})
+}
+
+func TestQueryVars(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"cpu": {
+			response("host=web01", 60, 1, 2, 3),
+		},
+	}}
+	for _, input := range []string{
+		`avg(q("sum:cpu{host=$host}", "1h", ""))`,
+		`avg(q("sum:cpu{host=${host}}", "1h", ""))`,
+	} {
+		e, err := New(input, TSDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Vars = map[string]string{"host": "web01"}
+		c.requests = nil
+		if _, _, err := e.Execute(c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.requests) != 1 {
+			t.Fatalf("%s: expected 1 query, got %d", input, len(c.requests))
+		}
+		if got := c.requests[0].Queries[0].Tags["host"]; got != "web01" {
+			t.Errorf("%s: expected host=web01, got host=%s", input, got)
+		}
+	}
+	testFuncs(t, c, []funcTest{
+		{expr: `avg(q("sum:cpu{host=$host}", "1h", ""))`, err: "q: unknown variable $host in query sum:cpu{host=$host}"},
+	})
+}
+
+func TestQueryRange(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 3600, 1, 2, 3, 4),
+		},
+	}}
+	// Points are 4h, 3h, 2h and 1h before testNow.
+	start, end := testNow.Unix()-4*3600, testNow.Unix()-2*3600
+	expr := fmt.Sprintf(`query_range("sum:m{host=*}", %d, %d, "avg")`, start, end)
+	testFuncs(t, c, []funcTest{
+		{expr: expr, output: map[string]float64{"{host=a}": 2}},
+		{expr: fmt.Sprintf(`query_range("sum:m{host=*}", %d, %d, "max")`, start, end), output: map[string]float64{"{host=a}": 3}},
+		{expr: fmt.Sprintf(`query_range("sum:m{host=*}", %d, %d, "avg")`, end, start), err: "start must be before end"},
+		{expr: fmt.Sprintf(`query_range("sum:m{host=*}", %d, %d, "mean")`, start, end), err: `unknown aggregator "mean"`},
+	})
+	r := c.requests[0]
+	if r.Start != start || r.End != end {
+		t.Errorf("expected range %d to %d, got %v to %v", start, end, r.Start, r.End)
+	}
+}
+
+func TestR2(t *testing.T) {
+	noise := make([]float64, 100)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range noise {
+		noise[i] = rnd.Float64()
+	}
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=linear", 60, 1, 3, 5, 7, 9),
+			response("host=falling", 60, 9, 6, 3, 0),
+			response("host=symmetric", 60, 1, 0, 0, 1),
+			response("host=flat", 60, 2, 2, 2),
+			response("host=short", 60, 1, 2),
+			response("host=noise", 60, noise...),
+		},
+	}}
+	r, err := testExpr(`r2(q("sum:m{host=*}", "1h", ""))`, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := resultValues(r)
+	for g, v := range map[string]float64{
+		"{host=linear}":    1,
+		"{host=falling}":   1,
+		"{host=symmetric}": 0,
+	} {
+		if math.Abs(got[g]-v) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v", g, v, got[g])
+		}
+	}
+	for _, g := range []string{"{host=flat}", "{host=short}"} {
+		if !math.IsNaN(got[g]) {
+			t.Errorf("%s: expected NaN, got %v", g, got[g])
+		}
+	}
+	if v := got["{host=noise}"]; !(v >= 0 && v < 0.1) {
+		t.Errorf("{host=noise}: expected r2 near 0, got %v", v)
+	}
+}
+
+func TestCrossings(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=step", 60, 1, 1, 1, 9, 9, 9),
+			response("host=flap", 60, 1, 9, 1, 9, 1, 9),
+			response("host=gap", 60, 9, nan, nan, 9, 1),
+			response("host=flat", 60, 1, 5, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `crossings(q("sum:m{host=*}", "1h", ""), 5)`, output: map[string]float64{
+			"{host=step}": 1,
+			"{host=flap}": 5,
+			"{host=gap}":  1,
+			"{host=flat}": 0,
+		}},
+	})
+}
+
+func TestPick(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=c", 60, 3),
+			response("host=a", 60, 9),
+			response("host=b", 60, 1),
+			response("host=d", 60, 9),
+			response("host=nan", 60, math.NaN()),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `pick(avg(q("sum:m{host=*}", "1h", "")), "max")`, output: map[string]float64{"{host=a}": 9}},
+		{expr: `pick(avg(q("sum:m{host=*}", "1h", "")), "min")`, output: map[string]float64{"{host=b}": 1}},
+		{expr: `pick(avg(q("sum:m{host=*}", "1h", "")), "avg")`, err: `unknown rule "avg"`},
+	})
+}
+
+func TestNaNRate(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=full", 60, 1, 2, 3, 4),
+			response("host=quarter", 60, 1, nan, 3, 4),
+			response("host=most", 60, nan, nan, 3, nan, nan),
+			response("host=none", 60, nan, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `nan_rate(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=full}":    0,
+			"{host=quarter}": 0.25,
+			"{host=most}":    0.8,
+			"{host=none}":    1,
+		}},
+	})
+}
+
+func TestActiveFor(t *testing.T) {
+	nan := math.NaN()
+	// The last point is 60s before testNow, so a run that starts at the
+	// final point has been active for a minute.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=continuous", 60, 10, 10, 10, 10),
+			response("host=interrupted", 60, 10, 10, 1, 10, 10),
+			response("host=gap", 60, 1, 10, nan, 10),
+			response("host=dropped", 60, 10, 10, 10, 1),
+			response("host=equal", 60, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `active_for("sum:m{host=*}", "1h", 5)`, output: map[string]float64{
+			"{host=continuous}":  240,
+			"{host=interrupted}": 120,
+			"{host=gap}":         180,
+			"{host=dropped}":     0,
+			"{host=equal}":       0,
+		}},
+	})
+}
+
+func TestMap(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 3),
+			response("host=b", 60, -3),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `map(avg(q("sum:m{host=*}", "1h", "")), "v() * v()")`, output: map[string]float64{"{host=a}": 4, "{host=b}": 9}},
+		{expr: `map(avg(q("sum:m{host=*}", "1h", "")), "v() > 0 && v() < 10")`, output: map[string]float64{"{host=a}": 1, "{host=b}": 0}},
+		{expr: `map(avg(q("sum:m{host=*}", "1h", "")), "v() * 2") + map(last(q("sum:m{host=*}", "1h", "")), "-v()")`, output: map[string]float64{"{host=a}": 1, "{host=b}": -3}},
+		{expr: `map(avg(q("sum:m{host=*}", "1h", "")), "v(")`, err: "map:"},
+		{expr: `map(avg(q("sum:m{host=*}", "1h", "")), "avg(v())")`, err: "map:"},
+	})
+}
+
+func TestPairs(t *testing.T) {
+	// b has a gap where a has its third point, which would break the
+	// correlation if it were not dropped.
+	gap := response("host=gap", 60, 2, 4, -50, 8)
+	delete(gap.DPS, strconv.FormatInt(testNow.Unix()-120, 10))
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"a": {
+			response("host=gap", 60, 1, 2, 3, 4),
+			response("host=neg", 60, 1, 2, 3),
+			response("host=flat", 60, 1, 2, 3),
+			response("host=alone", 60, 1, 2, 3),
+		},
+		"b": {
+			gap,
+			response("host=neg", 60, 3, 2, 1),
+			response("host=flat", 60, 5, 5, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `corr(pairs("sum:a{host=*}", "sum:b{host=*}", "1h"))`, output: map[string]float64{
+			"{host=gap}":  1,
+			"{host=neg}":  -1,
+			"{host=flat}": math.NaN(),
+		}},
+		{expr: `corr(pairs("sum:a{host=*}", "sum:b{host=*}", "1h")) > 0`, output: map[string]float64{
+			"{host=gap}":  1,
+			"{host=neg}":  0,
+			"{host=flat}": math.NaN(),
+		}},
+		{expr: `1 + pairs("sum:a{host=*}", "sum:b{host=*}", "1h")`, err: "type error"},
+	})
+	r, err := testExpr(`pairs("sum:a{host=gap}", "sum:b{host=gap}", "1h")`, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range r.Results {
+		if res.Group.String() != "{host=gap}" {
+			continue
+		}
+		p := res.Value.(Pairs)
+		if len(p) != 3 {
+			t.Errorf("expected 3 aligned pairs, got %v", p)
+		}
+		if v := p[time.Unix(testNow.Unix()-60, 0).UTC()]; v != (Pair{4, 8}) {
+			t.Errorf("expected the last pair to be {4 8}, got %v", v)
+		}
+	}
+}
+
+func TestChangePoint(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=shift", 60, 10, 11, 9, 10, 20, 21, 19, 20),
+			response("host=stationary", 60, 10, 11, 9, 10, 9, 11, 10, 10),
+			response("host=noisy", 60, 0, 20, 0, 20, 5, 25, 5, 25),
+			response("host=short", 60, 1, 100, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `changepoint(q("sum:m{host=*}", "1h", ""), 3)`, output: map[string]float64{
+			"{host=shift}":      1,
+			"{host=stationary}": 0,
+			"{host=noisy}":      0,
+			"{host=short}":      math.NaN(),
+		}},
+		{expr: `changepoint(q("sum:m{host=*}", "1h", ""), 0.4)`, output: map[string]float64{
+			"{host=shift}":      1,
+			"{host=stationary}": 0,
+			"{host=noisy}":      1,
+			"{host=short}":      math.NaN(),
+		}},
+	})
+}
+
+func TestCV(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=stable", 60, 99, 101, 99, 101),
+			response("host=noisy", 60, 0, 200, 0, 200),
+			response("host=zero", 60, -1, 1, -1, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `cv(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=stable}": math.Sqrt(4.0/3) / 100,
+			"{host=noisy}":  math.Sqrt(40000.0/3) / 100,
+			"{host=zero}":   math.NaN(),
+		}},
+	})
+}
+
+func TestWindowDuration(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {response("host=a", 60, 1, 2, 3)},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `avg(q("sum:m{host=*}", "0s", ""))`, err: `q: duration must be positive, got "0s"`},
+		{expr: `avg(q("sum:m{host=*}", "-5m", ""))`, err: `q: duration must be positive, got "-5m"`},
+		{expr: `change("sum:m{host=*}", "0s", "")`, err: `change: duration must be positive`},
+		{expr: `avg(band("sum:m{host=*}", "1h", "-5m", 1))`, err: `band: duration must be positive`},
+		{expr: `missing("sum:m{host=*}", "0", "1m")`, err: `missing: duration must be positive`},
+		{expr: `avg(q("sum:m{host=*}", "5m", "0s"))`, output: map[string]float64{"{host=a}": 2}},
+		{expr: `pct_change("sum:m{host=*}", "5m", "0s")`, output: map[string]float64{"{host=a}": 0}},
+	})
+}
+
+func TestBurnRate(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"good": {
+			response("svc=a", 60, 495, 490),
+			response("svc=b", 60, 1000),
+			response("svc=idle", 60, 0),
+			response("svc=alone", 60, 1),
+		},
+		"total": {
+			response("svc=a", 60, 500, 500),
+			response("svc=b", 60, 1000),
+			response("svc=idle", 60, 0),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		// 15 errors in 1000 requests is 1.5%, against a 1% budget.
+		{expr: `burn_rate("sum:good{svc=*}", "sum:total{svc=*}", "1h", 0.99)`, output: map[string]float64{
+			"{svc=a}":    1.5,
+			"{svc=b}":    0,
+			"{svc=idle}": math.NaN(),
+		}},
+		{expr: `burn_rate("sum:good{svc=*}", "sum:total{svc=*}", "1h", 1)`, err: "target must be between 0 and 1"},
+	})
+}
+
+func TestMode(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=clear", 60, 2, 1, 2, 3, 2),
+			response("host=tie", 60, 3, 1, 3, 1, 2),
+			response("host=nan", 60, nan, nan, nan, 4),
+			response("host=empty", 60, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `mode(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=clear}": 2,
+			"{host=tie}":   1,
+			"{host=nan}":   4,
+			"{host=empty}": math.NaN(),
+		}},
+	})
+}
+
+func TestGrowsFasterThan(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			// One per minute is 60 per hour.
+			response("host=leak", 60, 1, 2, 3, 4, 5),
+			response("host=slow", 60, 1, 1.5, 2, 2.5, 3),
+			response("host=falling", 60, 5, 4, 3, 2, 1),
+			response("host=single", 60, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `grows_faster_than(q("sum:m{host=*}", "1h", ""), 45)`, output: map[string]float64{
+			"{host=leak}":    1,
+			"{host=slow}":    0,
+			"{host=falling}": 0,
+			"{host=single}":  math.NaN(),
+		}},
+		{expr: `grows_faster_than(q("sum:m{host=*}", "1h", ""), 20)`, output: map[string]float64{
+			"{host=leak}":    1,
+			"{host=slow}":    1,
+			"{host=falling}": 0,
+			"{host=single}":  math.NaN(),
+		}},
+	})
+}
+
+func TestDevFromQ(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=above", 60, 1, 2, 3, 4, 10),
+			response("host=below", 60, 4, 6, 8, 10, 2),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `dev_from_q(q("sum:m{host=*}", "1h", ""), .5)`, output: map[string]float64{
+			"{host=above}": 7,
+			"{host=below}": -4,
+		}},
+		{expr: `dev_from_q(q("sum:m{host=*}", "1h", ""), 1)`, output: map[string]float64{
+			"{host=above}": 0,
+			"{host=below}": -8,
+		}},
+	})
+}
+
+func TestBreaches(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=burst", 60, 1, 9, 9, 9, 1, 1, 1, 1, 1, 9),
+			response("host=spread", 60, 9, 1, 1, 9, 1, 1, 9, 1, 1, 9),
+			response("host=quiet", 60, 1, 1, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `breaches("sum:m{host=*}", "1h", 5, "3m")`, output: map[string]float64{
+			"{host=burst}":  3,
+			"{host=spread}": 1,
+			"{host=quiet}":  0,
+		}},
+		{expr: `breaches("sum:m{host=*}", "1h", 5, "4m")`, output: map[string]float64{
+			"{host=burst}":  3,
+			"{host=spread}": 2,
+			"{host=quiet}":  0,
+		}},
+		{expr: `breaches("sum:m{host=*}", "1h", 5, "0s")`, err: "breaches: duration must be positive"},
+	})
+}
+
+func TestDecayAvg(t *testing.T) {
+	nan := math.NaN()
+	// The spike is the last point, 1m before testNow, and the other points
+	// are 2m and 3m old.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=spike", 60, 0, 0, 30),
+			response("host=flat", 60, 5, nan, 5),
+			response("host=empty", 60, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `decay_avg("sum:m{host=*}", "1h", "1m")`, output: map[string]float64{
+			"{host=spike}": 30 * 4.0 / 7,
+			"{host=flat}":  5,
+			"{host=empty}": math.NaN(),
+		}},
+		{expr: `decay_avg("sum:m{host=*}", "1h", "100h") < 10.1`, output: map[string]float64{
+			"{host=spike}": 1,
+			"{host=flat}":  1,
+			"{host=empty}": math.NaN(),
+		}},
+		{expr: `decay_avg("sum:m{host=*}", "1h", "-1m")`, err: "decay_avg: duration must be positive"},
+	})
+}
+
+func TestFlatline(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=stuck", 60, 21.5, 21.5, nan, 21.5),
+			response("host=varying", 60, 21.5, 21.51, 21.49, 21.5),
+			response("host=dead", 60, nan, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `flatline(q("sum:m{host=*}", "1h", ""), 0)`, output: map[string]float64{
+			"{host=stuck}":   1,
+			"{host=varying}": 0,
+			"{host=dead}":    math.NaN(),
+		}},
+		{expr: `flatline(q("sum:m{host=*}", "1h", ""), 0.05)`, output: map[string]float64{
+			"{host=stuck}":   1,
+			"{host=varying}": 1,
+			"{host=dead}":    math.NaN(),
+		}},
+	})
+}
+
+func TestIQR(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			// Sorted: 1 2 3 4 5 6 7 8 9, so Q1 is 3 and Q3 is 7.
+			response("host=a", 60, 9, 1, 8, 2, 7, 3, 6, 4, 5),
+			response("host=nan", 60, 10, nan, 20, 30, 40, nan),
+			response("host=empty", 60, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `iqr(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=a}":     4,
+			"{host=nan}":   20,
+			"{host=empty}": math.NaN(),
+		}},
+	})
+}
+
+func TestOutliers(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			// The clean series has fences at -3 and 13. The outliers
+			// widen the spiky one's to -6 and 18, leaving 13 inside.
+			response("host=clean", 60, 9, 1, 8, 2, 7, 3, 6, 4, 5),
+			response("host=spiky", 60, 9, 1, 8, 2, 7, 3, 6, 4, 5, 100, -50, 13),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `outliers(q("sum:m{host=*}", "1h", ""), 1.5)`, output: map[string]float64{
+			"{host=clean}": 0,
+			"{host=spiky}": 2,
+		}},
+		{expr: `outliers(q("sum:m{host=*}", "1h", ""), 0)`, output: map[string]float64{
+			"{host=clean}": 4,
+			"{host=spiky}": 5,
+		}},
+	})
+}
+
+func TestTimeTo(t *testing.T) {
+	// Each series' last point is 1m before testNow, so a trend of 1 per
+	// minute has moved on by 1 at testNow.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=rising", 60, 90, 91, 92, 93, 94),
+			response("host=falling", 60, 20, 18, 16, 14, 12),
+			response("host=flat", 60, 50, 50, 50),
+			response("host=noisy", 60, 0, 100, 0, 100, 1, 99, 0),
+			response("host=single", 60, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `time_to(q("sum:m{host=*}", "1h", ""), 100)`, output: map[string]float64{
+			"{host=rising}":  300,
+			"{host=falling}": math.Inf(1),
+			"{host=flat}":    math.NaN(),
+			"{host=noisy}":   math.NaN(),
+			"{host=single}":  math.NaN(),
+		}},
+		{expr: `time_to(q("sum:m{host=*}", "1h", ""), 0)`, output: map[string]float64{
+			"{host=rising}":  math.Inf(1),
+			"{host=falling}": 300,
+			"{host=flat}":    math.NaN(),
+			"{host=noisy}":   math.NaN(),
+			"{host=single}":  math.NaN(),
+		}},
+	})
+}
+
+func TestAcceleration(t *testing.T) {
+	// With x in minutes the quadratic series is x², so its second
+	// derivative is 2 per minute squared.
+	perMin2 := 2.0 / 3600
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=up", 60, 0, 1, 4, 9, 16),
+			response("host=down", 60, 100, 99, 96, 91, 84),
+			response("host=linear", 60, 1, 3, 5, 7),
+			response("host=short", 60, 1, 2),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `acceleration(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=up}":     perMin2,
+			"{host=down}":   -perMin2,
+			"{host=linear}": 0,
+			"{host=short}":  math.NaN(),
+		}},
+	})
+	// It is a builtin, so it also applies to other backends' series.
+	if _, err := New(`acceleration(graphite("a.b", "1h", "", "host"))`, Graphite); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSameTimeLastWeek(t *testing.T) {
+	const week = 7 * 24 * time.Hour
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			shifted(response("host=a", 60, 10, 30), week, response("host=a", 60, 100, 100)),
+			shifted(response("host=b", 60, 5), week+time.Hour),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `same_time_last_week("sum:m{host=*}", "1h")`, output: map[string]float64{"{host=a}": 20}},
+		{expr: `same_time_last_week("sum:m{host=*}", "0s")`, err: "duration must be positive"},
+	})
+	c.requests = nil
+	if _, err := testExpr(`same_time_last_week("sum:m{host=*}", "1h")`, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(c.requests))
+	}
+	r := c.requests[0]
+	start, err := opentsdb.ParseTime(r.Start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := opentsdb.ParseTime(r.End)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testNow.Add(-week - time.Hour); !start.Equal(want) {
+		t.Errorf("expected start %v, got %v", want, start)
+	}
+	if want := testNow.Add(-week); !end.Equal(want) {
+		t.Errorf("expected end %v, got %v", want, end)
+	}
+}
+
+func TestPersistedAvg(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 10),
+			response("host=b", 60, 20),
+		},
+	}}
+	e, err := New(`persisted_avg(avg(q("sum:m{host=*}", "1h", "")), 0.75) + persisted_avg(avg(q("sum:m{host=*}", "1h", "")), 0)`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute := func(prior PersistedState) (map[string]float64, PersistedState) {
+		r, _, next, err := e.ExecuteWithPrior(prior, c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultValues(r), next
+	}
+	// Without history both calls return the current values.
+	got, state := execute(nil)
+	if want := map[string]float64{"{host=a}": 20, "{host=b}": 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first execution: expected %v, got %v", want, got)
+	}
+	if len(state) != 4 {
+		t.Errorf("expected state for two calls and two groups, got %v", state)
+	}
+	c.responses["m"] = opentsdb.ResponseSet{
+		response("host=a", 60, 50),
+		response("host=b", 60, 20),
+		response("host=c", 60, 1),
+	}
+	// The first call moves a quarter of the way to the new value, the second
+	// follows it immediately, and the new group has no history.
+	got, state = execute(state)
+	if want := map[string]float64{"{host=a}": 70, "{host=b}": 40, "{host=c}": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second execution: expected %v, got %v", want, got)
+	}
+	got, _ = execute(state)
+	if want := map[string]float64{"{host=a}": 77.5, "{host=b}": 40, "{host=c}": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("third execution: expected %v, got %v", want, got)
+	}
+	testFuncs(t, c, []funcTest{
+		{expr: `persisted_avg(avg(q("sum:m{host=*}", "1h", "")), 0.5)`, output: map[string]float64{"{host=a}": 50, "{host=b}": 20, "{host=c}": 1}},
+		{expr: `persisted_avg(avg(q("sum:m{host=*}", "1h", "")), 2)`, err: "weight must be between 0 and 1"},
+	})
+}
+
+func TestFracBreaching(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 90),
+			response("host=b", 60, 95),
+			response("host=c", 60, 10),
+			response("host=d", 60, 50),
+			response("host=e", 60, nan),
+		},
+		"dead": {
+			response("host=a", 60, nan),
+			response("host=b", 60, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `frac_breaching(avg(q("sum:m{host=*}", "1h", "")), 80)`, output: map[string]float64{"{}": 0.5}},
+		{expr: `frac_breaching(avg(q("sum:m{host=*}", "1h", "")), 92)`, output: map[string]float64{"{}": 0.25}},
+		{expr: `frac_breaching(avg(q("sum:m{host=*}", "1h", "")), 80) > 0.2`, output: map[string]float64{"{}": 1}},
+		{expr: `frac_breaching(avg(q("sum:dead{host=*}", "1h", "")), 80)`, output: map[string]float64{"{}": math.NaN()}},
+	})
+}
+
+func TestWorstGroup(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("dc=ny,host=c", 60, 3),
+			response("dc=ny,host=a", 60, 9),
+			response("dc=la,host=b", 60, 1),
+			response("dc=ny,host=d", 60, 9),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `worst_group(avg(q("sum:m{host=*,dc=*}", "1h", "")), "max")`, output: map[string]float64{"{dc=ny,host=a}": 9}},
+		{expr: `worst_group(avg(q("sum:m{host=*,dc=*}", "1h", "")), "min")`, output: map[string]float64{"{dc=la,host=b}": 1}},
+		{expr: `worst_group(avg(q("sum:m{host=*,dc=*}", "1h", "")), "last")`, err: `worst_group: unknown rule "last"`},
+	})
+	r, err := testExpr(`worst_group(avg(q("sum:m{host=*,dc=*}", "1h", "")), "max")`, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labeled := false
+	for _, c := range r.Results[0].Computations {
+		labeled = labeled || c.Text == "dc=ny,host=a"
+	}
+	if !labeled {
+		t.Errorf("expected the result to be labeled dc=ny,host=a, got %v", r.Results[0].Computations)
+	}
+}
+
+func TestActiveRate(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			// Active at 1/s and 3/s for a minute each, idle for two minutes.
+			response("host=bursty", 60, 0, 60, 60, 60, 240),
+			// Reset after the first minute.
+			response("host=reset", 60, 100, 160, 0, 60),
+			response("host=idle", 60, 5, 5, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `active_rate(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=bursty}": 2,
+			"{host=reset}":  1,
+			"{host=idle}":   math.NaN(),
+		}},
+	})
+}
+
+func TestPeriod(t *testing.T) {
+	// Three days of hourly points following a daily cycle, and white noise.
+	var daily, noise []float64
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 72; i++ {
+		daily = append(daily, 50+20*math.Sin(2*math.Pi*float64(i)/24))
+	}
+	for i := 0; i < 200; i++ {
+		noise = append(noise, rnd.NormFloat64())
+	}
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=daily", 3600, daily...),
+			response("host=noise", 60, noise...),
+			response("host=flat", 60, 1, 1, 1, 1, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `period(q("sum:m{host=*}", "1w", ""))`, output: map[string]float64{
+			"{host=daily}": 86400,
+			"{host=noise}": math.NaN(),
+			"{host=flat}":  math.NaN(),
+		}},
+	})
+}
+
+func TestHighwater(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 3, nan, 7, 5),
+			response("host=b", 60, nan, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `highwater(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": 7, "{host=b}": math.NaN()}},
+	})
+
+	e, err := New(`persisted_max(highwater(q("sum:m{host=*}", "1h", "")))`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state PersistedState
+	for i, step := range []struct {
+		responses opentsdb.ResponseSet
+		want      map[string]float64
+	}{
+		{opentsdb.ResponseSet{response("host=a", 60, 3, 7)}, map[string]float64{"{host=a}": 7}},
+		{opentsdb.ResponseSet{response("host=a", 60, 2), response("host=b", 60, 4)}, map[string]float64{"{host=a}": 7, "{host=b}": 4}},
+		{opentsdb.ResponseSet{response("host=b", 60, 1)}, map[string]float64{"{host=b}": 4}},
+		{opentsdb.ResponseSet{response("host=a", 60, 9), response("host=b", 60, nan)}, map[string]float64{"{host=a}": 9, "{host=b}": 4}},
+	} {
+		c.responses["m"] = step.responses
+		var r *Results
+		r, _, state, err = e.ExecuteWithPrior(state, c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resultValues(r); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("execution %d: expected %v, got %v", i, step.want, got)
+		}
+	}
+}
+
+func TestLowwater(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"free": {
+			response("host=a", 60, 30, nan, 12, 20),
+			response("host=b", 60, nan, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `lowwater(q("sum:free{host=*}", "1h", ""))`, output: map[string]float64{"{host=a}": 12, "{host=b}": math.NaN()}},
+	})
+
+	e, err := New(`persisted_min(lowwater(q("sum:free{host=*}", "1h", "")))`, TSDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state PersistedState
+	for i, step := range []struct {
+		responses opentsdb.ResponseSet
+		want      map[string]float64
+	}{
+		{opentsdb.ResponseSet{response("host=a", 60, 30, 12)}, map[string]float64{"{host=a}": 12}},
+		{opentsdb.ResponseSet{response("host=a", 60, 40), response("host=b", 60, 8)}, map[string]float64{"{host=a}": 12, "{host=b}": 8}},
+		{opentsdb.ResponseSet{response("host=b", 60, 9)}, map[string]float64{"{host=b}": 8}},
+		{opentsdb.ResponseSet{response("host=a", 60, 5), response("host=b", 60, nan)}, map[string]float64{"{host=a}": 5, "{host=b}": 8}},
+	} {
+		c.responses["free"] = step.responses
+		var r *Results
+		r, _, state, err = e.ExecuteWithPrior(state, c, nil, nil, cache.New(0), nil, testNow, 0, false, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resultValues(r); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("execution %d: expected %v, got %v", i, step.want, got)
+		}
+	}
+}
+
+func TestPoissonAnomaly(t *testing.T) {
+	// The history averages 2 events, and P(X >= k) for lambda 2 is
+	// 1 - e^-2 (1 + 2 + 2 + 4/3 + ...) summed over i < k.
+	e2 := math.Exp(-2)
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=usual", 60, 1, 3, 2, 2),
+			response("host=spike", 60, 1, 3, 2, 6),
+			response("host=zero", 60, 1, 3, 2, 0),
+			response("host=short", 60, 2, 9),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `poisson_anomaly(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=usual}": 1 - e2*(1+2),
+			"{host=spike}": 1 - e2*(1+2+2+4.0/3+2.0/3+4.0/15),
+			"{host=zero}":  1,
+			"{host=short}": math.NaN(),
+		}},
+		{expr: `poisson_anomaly(q("sum:m{host=*}", "1h", "")) < 0.05`, output: map[string]float64{
+			"{host=usual}": 0,
+			"{host=spike}": 1,
+			"{host=zero}":  0,
+			"{host=short}": math.NaN(),
+		}},
+	})
+
+	// Large means, where e^-lambda underflows. The expected tails were
+	// summed independently.
+	c = &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=at", 60, 1000, 1000, 1000),
+			response("host=below", 60, 1000, 1000, 900),
+			response("host=above", 60, 1000, 1000, 1100),
+			response("host=huge", 60, 1000, 1000, 1e9),
+			response("host=million", 60, 1e6, 1e6, 1e6),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `poisson_anomaly(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=at}":      0.5042052441800837,
+			"{host=below}":   0.9993774022154737,
+			"{host=above}":   0.0009626304058662804,
+			"{host=huge}":    0,
+			"{host=million}": 0.5001329801613407,
+		}},
+	})
+}
+
+func TestWinsorize(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=clean", 60, 10, 11, 9, 10, 12, 8, 10, 11, 9, 10),
+			response("host=spike", 60, 10, 11, 9, 10, 12, 8, 10, 11, 9, 1000),
+			response("host=nan", 60, 1, nan, 2, 3, 100),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		// One value at each end of the ten points is clamped to its
+		// neighbour, so the spike counts as 12.
+		{expr: `avg(winsorize(q("sum:m{host=*}", "1h", ""), 10))`, output: map[string]float64{
+			"{host=clean}": 10,
+			"{host=spike}": 10.3,
+			"{host=nan}":   math.NaN(),
+		}},
+		{expr: `max(winsorize(q("sum:m{host=*}", "1h", ""), 25))`, output: map[string]float64{
+			"{host=clean}": 11,
+			"{host=spike}": 11,
+			"{host=nan}":   3,
+		}},
+		{expr: `avg(winsorize(q("sum:m{host=*}", "1h", ""), 0))`, output: map[string]float64{
+			"{host=clean}": 10,
+			"{host=spike}": 109,
+			"{host=nan}":   math.NaN(),
+		}},
+		{expr: `avg(winsorize(q("sum:m{host=*}", "1h", ""), 50))`, err: "pct must be in [0, 50)"},
+	})
+}
+
+func TestTWA(t *testing.T) {
+	nan := math.NaN()
+	// irregular holds 10 for 8m, then 40 for 1m until its last point, 1m
+	// before testNow.
+	irregular := response("host=irregular", 60, 40, 40)
+	irregular.DPS[strconv.FormatInt(testNow.Unix()-600, 10)] = 10
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			irregular,
+			response("host=regular", 60, 1, 2, 3),
+			response("host=gap", 60, 4, nan, 8),
+			response("host=single", 60, 7),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `twa(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=irregular}": 40.0 / 3,
+			"{host=regular}":   1.5,
+			"{host=gap}":       4,
+			"{host=single}":    7,
+		}},
+		{expr: `avg(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=irregular}": 30,
+			"{host=regular}":   2,
+			"{host=gap}":       math.NaN(),
+			"{host=single}":    7,
+		}},
+	})
+}
+
+func TestSinceBreach(t *testing.T) {
+	// The last point is 1m before testNow.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=mid", 60, 1, 1, 9, 9, 1, 1),
+			response("host=now", 60, 9, 1, 9),
+			response("host=never", 60, 1, 5, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `since_breach("sum:m{host=*}", "1h", 5)`, output: map[string]float64{
+			"{host=mid}":   180,
+			"{host=now}":   60,
+			"{host=never}": 3600,
+		}},
+		{expr: `since_breach("sum:m{host=*}", "-1h", 5)`, err: "since_breach: duration must be positive"},
+	})
+}
+
+func TestTheilSen(t *testing.T) {
+	// Both series rise by 1 per minute, but one has a large outlier that
+	// pulls the least-squares fit far off.
+	long := make([]float64, 2000)
+	for i := range long {
+		long[i] = float64(i)
+	}
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=clean", 60, 0, 1, 2, 3, 4, 5, 6, 7),
+			response("host=outlier", 60, 0, 1, 2, 3, 4, 5, 6, 500),
+			response("host=long", 60, long...),
+			response("host=single", 60, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `theilsen(q("sum:m{host=*}", "1w", "")) * 60`, output: map[string]float64{
+			"{host=clean}":   1,
+			"{host=outlier}": 1,
+			"{host=long}":    1,
+			"{host=single}":  math.NaN(),
+		}},
+		{expr: `grows_faster_than(q("sum:m{host=*}", "1w", ""), 600)`, output: map[string]float64{
+			"{host=clean}":   0,
+			"{host=outlier}": 1,
+			"{host=long}":    0,
+			"{host=single}":  math.NaN(),
+		}},
+	})
+}
+
+func TestEWVar(t *testing.T) {
+	nan := math.NaN()
+	// With alpha 0.5, 1 2 3 gives means 1, 1.5, 2.25 and variances 0,
+	// 0.5 * (0 + 1*0.5) = 0.25 and 0.5 * (0.25 + 1.5*0.75) = 0.6875.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, nan, 2, 3),
+			response("host=flat", 60, 4, 4, 4),
+			response("host=empty", 60, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `ewma(q("sum:m{host=*}", "1h", ""), 0.5)`, output: map[string]float64{
+			"{host=a}":     2.25,
+			"{host=flat}":  4,
+			"{host=empty}": math.NaN(),
+		}},
+		{expr: `ewvar(q("sum:m{host=*}", "1h", ""), 0.5)`, output: map[string]float64{
+			"{host=a}":     0.6875,
+			"{host=flat}":  0,
+			"{host=empty}": math.NaN(),
+		}},
+		{expr: `ewvar(q("sum:m{host=*}", "1h", ""), 1)`, output: map[string]float64{
+			"{host=a}":     0,
+			"{host=flat}":  0,
+			"{host=empty}": math.NaN(),
+		}},
+		{expr: `ewvar(q("sum:m{host=*}", "1h", ""), 0)`, err: "ewvar: alpha must be in (0, 1]"},
+		{expr: `ewma(q("sum:m{host=*}", "1h", ""), 1.5)`, err: "ewma: alpha must be in (0, 1]"},
+	})
+}
+
+func TestTrailingNaN(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=present", 60, 1, nan, 2, 3),
+			response("host=one", 60, 1, 2, nan),
+			response("host=three", 60, 1, nan, 2, nan, nan, nan),
+			response("host=dead", 60, nan, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `trailing_nan(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=present}": 0,
+			"{host=one}":     1,
+			"{host=three}":   3,
+			"{host=dead}":    2,
+		}},
+	})
+}
+
+func TestCUSUM(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			// Drifts up by 1 each step past the slack of 1 around 10.
+			response("host=drift", 60, 10, 11, 12, 13, 14, 15),
+			response("host=stationary", 60, 10, 10.5, 9.5, 10, 10.5, 9.5),
+			response("host=falling", 60, 10, 8, 6),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `cusum(q("sum:m{host=*}", "1h", ""), 10, 1, "high")`, output: map[string]float64{
+			"{host=drift}":      10,
+			"{host=stationary}": 0,
+			"{host=falling}":    0,
+		}},
+		{expr: `cusum(q("sum:m{host=*}", "1h", ""), 10, 1, "low")`, output: map[string]float64{
+			"{host=drift}":      0,
+			"{host=stationary}": 0,
+			"{host=falling}":    4,
+		}},
+		{expr: `cusum(q("sum:m{host=*}", "1h", ""), 10, 1, "high") > 5`, output: map[string]float64{
+			"{host=drift}":      1,
+			"{host=stationary}": 0,
+			"{host=falling}":    0,
+		}},
+		{expr: `cusum(q("sum:m{host=*}", "1h", ""), 10, 1, "both")`, err: `unknown direction "both"`},
+	})
+}
+
+func TestEntropy(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=constant", 60, 3, 3, 3, 3),
+			response("host=two", 60, 0, 1, nan, 1, 0),
+			response("host=four", 60, 1, 2, 3, 4),
+			response("host=skewed", 60, 0, 0, 0, 1),
+			response("host=empty", 60, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `entropy(q("sum:m{host=*}", "1h", ""))`, output: map[string]float64{
+			"{host=constant}": 0,
+			"{host=two}":      1,
+			"{host=four}":     2,
+			"{host=skewed}":   -(0.75*math.Log2(0.75) + 0.25*math.Log2(0.25)),
+			"{host=empty}":    math.NaN(),
+		}},
+	})
+}
+
+func TestRateAgg(t *testing.T) {
+	// Steady at 1/s apart from one minute at 31/s, and a reset that is
+	// dropped rather than counted as a negative rate.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=spike", 60, 0, 60, 120, 1980, 2040, 2100),
+			response("host=reset", 60, 100, 160, 10, 70),
+			response("host=single", 60, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `rate_agg(q("sum:m{host=*}", "1h", ""), "avg")`, output: map[string]float64{
+			"{host=spike}":  7,
+			"{host=reset}":  1,
+			"{host=single}": math.NaN(),
+		}},
+		{expr: `rate_agg(q("sum:m{host=*}", "1h", ""), "max")`, output: map[string]float64{
+			"{host=spike}":  31,
+			"{host=reset}":  1,
+			"{host=single}": math.NaN(),
+		}},
+		{expr: `rate_agg(q("sum:m{host=*}", "1h", ""), "p95")`, output: map[string]float64{
+			"{host=spike}":  31,
+			"{host=reset}":  1,
+			"{host=single}": math.NaN(),
+		}},
+		{expr: `rate_agg(q("sum:m{host=*}", "1h", ""), "p99")`, err: `unknown aggregator "p99", expected one of: avg, max, p95`},
+	})
+}
+
+func TestPRatio(t *testing.T) {
+	// For 1..10, p90 is the value at index ceil(.9*9) = 9, which is 10, and
+	// p50 the value at index ceil(.5*9) = 5, which is 6.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10),
+			response("host=b", 60, 0, 0, 0, 0, 0, 0, 0, 0, 0, 100),
+			response("host=c", 60, 4, 4, 4, 4),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `p_ratio(q("sum:m{host=*}", "1h", ""), .9, .5)`, output: map[string]float64{
+			"{host=a}": 10.0 / 6,
+			"{host=b}": math.NaN(),
+			"{host=c}": 1,
+		}},
+		{expr: `p_ratio(q("sum:m{host=*}", "1h", ""), 1, 0)`, output: map[string]float64{
+			"{host=a}": 10,
+			"{host=b}": math.NaN(),
+			"{host=c}": 1,
+		}},
+	})
+}
+
+func TestRecovered(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=healed", 60, 1, 9, 9, 2, 1),
+			response("host=broken", 60, 1, 9, 1, 9),
+			response("host=never", 60, 1, 5, 1),
+			response("host=nan", 60, 9, 1, math.NaN()),
+			response("host=single", 60, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `recovered("sum:m{host=*}", "1h", 5)`, output: map[string]float64{
+			"{host=healed}": 1,
+			"{host=broken}": 0,
+			"{host=never}":  0,
+			"{host=nan}":    1,
+			"{host=single}": 0,
+		}},
+		{expr: `recovered("sum:m{host=*}", "0s", 5)`, err: "recovered: duration must be positive"},
+	})
+}
+
+func TestSeasonalZScore(t *testing.T) {
+	// periodic returns a minutely series whose points in the nth hour before
+	// testNow all have value windows[n].
+	periodic := func(tags string, windows ...float64) *opentsdb.Response {
+		r := response(tags, 60)
+		for k := int64(1); k < 60*int64(len(windows)); k++ {
+			r.DPS[strconv.FormatInt(testNow.Unix()-k*60, 10)] = opentsdb.Point(windows[k/60])
+		}
+		return r
+	}
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			periodic("host=anomaly", 20, 10, 12, 14),
+			periodic("host=normal", 13, 10, 12, 14),
+			periodic("host=flat", 50, 10, 10, 10),
+			periodic("host=new", 10),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `seasonal_zscore("sum:m{host=*}", "5m", "1h", 3)`, output: map[string]float64{
+			"{host=anomaly}": 4,
+			"{host=normal}":  .5,
+			"{host=flat}":    math.NaN(),
+			"{host=new}":     math.NaN(),
+		}},
+		{expr: `seasonal_zscore("sum:m{host=*}", "5m", "1h", 1)`, err: "seasonal_zscore: count must be between 2 and 100"},
+		{expr: `seasonal_zscore("sum:m{host=*}", "5m", "0h", 3)`, err: "seasonal_zscore: duration must be positive"},
+	})
+}
+
+func TestShare(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a,dc=ny", 60, 0, 50, 100, 150),
+			response("host=a,dc=la", 60, 10, 10, 40, 20, 30),
+			response("host=b,dc=ny", 60, 100, 110, 120),
+			response("host=c,dc=ny", 60, 5),
+		},
+		"flat": {
+			response("host=a", 60, 7, 7),
+			response("host=b", 60, 3, 3),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		// a increases by 150 in ny and 30+20+10 in la, with a reset to 20.
+		{expr: `share("sum:m{host=*,dc=*}", "1h", "host", "a")`, output: map[string]float64{
+			"{}": 210.0 / 230,
+		}},
+		{expr: `share("sum:m{host=*,dc=*}", "1h", "host", "b")`, output: map[string]float64{
+			"{}": 20.0 / 230,
+		}},
+		{expr: `share("sum:m{host=*,dc=*}", "1h", "host", "z")`, output: map[string]float64{
+			"{}": 0,
+		}},
+		{expr: `share("sum:flat{host=*}", "1h", "host", "a")`, output: map[string]float64{
+			"{}": math.NaN(),
+		}},
+	})
+}
+
+func TestSLA(t *testing.T) {
+	// Points are a minute apart and the last holds for the minute until
+	// testNow, so each point is weighted equally.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=cross", 60, 99, 99, 80, 80, 80, 99, 99, 99, 99, 99),
+			response("host=good", 60, 99.5, 100),
+			response("host=edge", 60, 95, math.NaN(), 90),
+		},
+		"irregular": {
+			shifted(response("host=a", 60, 0), 9*time.Minute, response("host=a", 60, 10)),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `sla("sum:m{host=*}", "1h", 95, "higher")`, output: map[string]float64{
+			"{host=cross}": 70,
+			"{host=good}":  100,
+			"{host=edge}":  200.0 / 3,
+		}},
+		{expr: `sla("sum:m{host=*}", "1h", 95, "lower")`, output: map[string]float64{
+			"{host=cross}": 30,
+			"{host=good}":  0,
+			"{host=edge}":  100,
+		}},
+		// 0 holds for 9 minutes, then 10 holds for the last minute.
+		{expr: `sla("sum:irregular{host=*}", "1h", 5, "higher")`, output: map[string]float64{
+			"{host=a}": 10,
+		}},
+		{expr: `sla("sum:m{host=*}", "1h", 95, "up")`, err: `sla: unknown direction "up", expected higher or lower`},
+	})
+}
+
+func TestFlapRate(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"alert": {
+			response("alert=steady", 60, 1, 1, 1, 1, 1, 1),
+			response("alert=off", 60, 0, 0, 0),
+			response("alert=flapping", 60, 0, 1, 0, 2, 0, 1, math.NaN(), 1, 0),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `flap_rate("sum:alert{alert=*}", "1h")`, output: map[string]float64{
+			"{alert=steady}":   0,
+			"{alert=off}":      0,
+			"{alert=flapping}": 6,
+		}},
+		{expr: `flap_rate("sum:alert{alert=*}", "30m")`, output: map[string]float64{
+			"{alert=steady}":   0,
+			"{alert=off}":      0,
+			"{alert=flapping}": 12,
+		}},
+		{expr: `flap_rate("sum:alert{alert=*}", "0m")`, err: "flap_rate: duration must be positive"},
+	})
+}
+
+func TestResidual(t *testing.T) {
+	// The baseline for host=gap has no point at the observed spike, so the
+	// spike is not part of the residual.
+	gap := response("host=gap", 60, 10, 10, 10, 10)
+	delete(gap.DPS, strconv.FormatInt(testNow.Unix()-120, 10))
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"observed": {
+			response("host=match", 60, 10, 20, 30, 40),
+			response("host=off", 60, 10, 25, 30, 10),
+			response("host=gap", 60, 10, 10, 500, 10),
+			response("host=alone", 60, 1, 2),
+		},
+		"baseline": {
+			response("host=match", 60, 10, 20, 30, 40.5),
+			response("host=off", 60, 10, 20, 30, 40),
+			gap,
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `residual(pairs("sum:observed{host=*}", "sum:baseline{host=*}", "1h"), "avg")`, output: map[string]float64{
+			"{host=match}": .125,
+			"{host=off}":   8.75,
+			"{host=gap}":   0,
+		}},
+		{expr: `residual(pairs("sum:observed{host=*}", "sum:baseline{host=*}", "1h"), "max")`, output: map[string]float64{
+			"{host=match}": .5,
+			"{host=off}":   30,
+			"{host=gap}":   0,
+		}},
+		{expr: `residual(pairs("sum:observed{host=*}", "sum:baseline{host=*}", "1h"), "sum")`, output: map[string]float64{
+			"{host=match}": .5,
+			"{host=off}":   35,
+			"{host=gap}":   0,
+		}},
+		{expr: `residual(pairs("sum:observed{host=*}", "sum:baseline{host=*}", "1h"), "mean")`, err: `residual: unknown aggregator "mean", expected one of: avg, last, max, min, sum`},
+	})
+}
+
+func TestCardinality(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"few": {
+			response("host=a,dc=ny", 60, 1),
+			response("host=a,dc=la", 60, 1),
+			response("host=b,dc=ny", 60, 1),
+		},
+		"many": {
+			response("host=a,dc=ny", 60, 1),
+			response("host=a,dc=ny", 60, 2),
+			response("host=b,dc=ny", 60, 1),
+			response("host=c,dc=ny", 60, 1),
+			response("host=d,dc=ny", 60, 1),
+			response("host=e,dc=la", 60, 1),
+			// Only has points before the window.
+			shifted(response("host=f,dc=la", 60, 1), 2*time.Hour),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `cardinality("sum:few{host=*,dc=*}", "1h")`, output: map[string]float64{
+			"{}": 3,
+		}},
+		{expr: `cardinality("sum:many{host=*,dc=*}", "1h")`, output: map[string]float64{
+			"{}": 5,
+		}},
+		{expr: `count("sum:many{host=*,dc=*}", "1h", "")`, output: map[string]float64{
+			"{}": 7,
+		}},
+		{expr: `cardinality("sum:many{host=*,dc=*}", "1h") > cardinality("sum:few{host=*,dc=*}", "1h")`, output: map[string]float64{
+			"{}": 1,
+		}},
+	})
+}
+
+func TestXCorrLag(t *testing.T) {
+	a := []float64{3, 9, 1, 7, 4, 8, 2, 6, 5, 0, 7, 3}
+	// led is a delayed by two minutes, so b repeats a's values later.
+	led := append([]float64{5, 5}, a[:len(a)-2]...)
+	// lagged is a two minutes ahead, most correlated at a negative lag.
+	lagged := append(append([]float64{}, a[2:]...), 5, 5)
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"a": {
+			response("host=same", 60, a...),
+			response("host=led", 60, a...),
+			response("host=lagged", 60, a...),
+			response("host=short", 60, a...),
+			response("host=alone", 60, a...),
+		},
+		"b": {
+			response("host=same", 60, a...),
+			response("host=led", 60, led...),
+			response("host=lagged", 60, lagged...),
+			response("host=short", 60, 1, 2),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `xcorr_lag("sum:a{host=*}", "sum:b{host=*}", "1h", "5m")`, output: map[string]float64{
+			"{host=same}":   0,
+			"{host=led}":    120,
+			"{host=lagged}": -120,
+			"{host=short}":  math.NaN(),
+			"{host=alone}":  math.NaN(),
+		}},
+		{expr: `xcorr_lag("sum:a{host=*}", "sum:b{host=*}", "1h", "-1m")`, err: "xcorr_lag: maxLag must not be negative"},
+	})
+}
+
+func TestAboveSeconds(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			// Above from 5m to 2m before testNow.
+			response("host=burst", 60, 1, 1, 9, 9, 9, 1, 1),
+			// The last point holds until testNow.
+			response("host=now", 60, 1, 9),
+			response("host=never", 60, 1, 5, 1),
+			// The gap does not end the run: 9 holds until the next point.
+			response("host=gap", 60, 9, nan, nan, 1),
+		},
+		"irregular": {
+			shifted(response("host=a", 60, 10), 10*time.Minute, response("host=a", 60, 0, 10)),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `above_seconds("sum:m{host=*}", "1h", 5)`, output: map[string]float64{
+			"{host=burst}": 180,
+			"{host=now}":   60,
+			"{host=never}": 0,
+			"{host=gap}":   180,
+		}},
+		// 10 holds for 9 minutes, then 0 for a minute and 10 for the last.
+		{expr: `above_seconds("sum:irregular{host=*}", "1h", 5)`, output: map[string]float64{
+			"{host=a}": 600,
+		}},
+		{expr: `above_seconds("sum:m{host=*}", "-1h", 5)`, err: "above_seconds: duration must be positive"},
+	})
+}
+
+func TestBucketize(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"latency": {
+			response("host=a", 60, 3, 12, 17, 10, 25, 9, 0, 14, nan),
+			response("host=b", 60, -4, 4.5, 1),
+			response("host=c", 60, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `bucketize(q("sum:latency{host=*}", "1h", ""), 10)`, output: map[string]float64{
+			"{bucket=0,host=a}":   3,
+			"{bucket=10,host=a}":  4,
+			"{bucket=20,host=a}":  1,
+			"{bucket=-10,host=b}": 1,
+			"{bucket=0,host=b}":   2,
+		}},
+		{expr: `bucketize(q("sum:latency{host=*}", "1h", ""), 2.5)`, output: map[string]float64{
+			"{bucket=0,host=a}":    1,
+			"{bucket=2.5,host=a}":  1,
+			"{bucket=7.5,host=a}":  1,
+			"{bucket=10,host=a}":   2,
+			"{bucket=12.5,host=a}": 1,
+			"{bucket=15,host=a}":   1,
+			"{bucket=25,host=a}":   1,
+			"{bucket=-5,host=b}":   1,
+			"{bucket=0,host=b}":    1,
+			"{bucket=2.5,host=b}":  1,
+		}},
+		{expr: `bucketize(q("sum:latency{host=*}", "1h", ""), 0)`, err: "bucketize: bucket size must be positive"},
+		{expr: `bucketize(rename(q("sum:latency{host=*}", "1h", ""), "host=bucket"), 10)`, err: "bucketize: bucket already in group"},
+	})
+}
+
+func TestWPercentile(t *testing.T) {
+	// host=a has 10 requests at 100ms, 80 at 20ms and 10 at 500ms, so the
+	// weighted median is 20 and p95 is 500 even though 100 is the middle value.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"latency": {
+			response("host=a", 60, 100, 20, 500),
+			response("host=even", 60, 1, 2, 3, 4),
+			response("host=idle", 60, 1, 2),
+			response("host=gap", 60, 7, 1000),
+		},
+		"requests": {
+			response("host=a", 60, 10, 80, 10),
+			response("host=even", 60, 1, 1, 1, 1),
+			response("host=idle", 60, 0, 0),
+			// The 7ms point has no weight at its timestamp.
+			response("host=gap", 60, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `wpercentile(pairs("sum:latency{host=*}", "sum:requests{host=*}", "1h"), .5)`, output: map[string]float64{
+			"{host=a}":    20,
+			"{host=even}": 2,
+			"{host=idle}": math.NaN(),
+			"{host=gap}":  1000,
+		}},
+		{expr: `wpercentile(pairs("sum:latency{host=*}", "sum:requests{host=*}", "1h"), .95)`, output: map[string]float64{
+			"{host=a}":    500,
+			"{host=even}": 4,
+			"{host=idle}": math.NaN(),
+			"{host=gap}":  1000,
+		}},
+		{expr: `wpercentile(pairs("sum:latency{host=*}", "sum:requests{host=*}", "1h"), .85)`, output: map[string]float64{
+			"{host=a}":    100,
+			"{host=even}": 4,
+			"{host=idle}": math.NaN(),
+			"{host=gap}":  1000,
+		}},
+	})
+}
+
+func TestInBand(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=stable", 60, 50, 51, 49, 50),
+			response("host=mixed", 60, 50, 45, 55, 44, 60, 50, nan),
+			response("host=off", 60, 10, 90),
+			response("host=nan", 60, nan, nan),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `in_band("sum:m{host=*}", "1h", 50, 5)`, output: map[string]float64{
+			"{host=stable}": 1,
+			"{host=mixed}":  4.0 / 6,
+			"{host=off}":    0,
+			"{host=nan}":    math.NaN(),
+		}},
+		{expr: `in_band("sum:m{host=*}", "1h", 50, 0)`, output: map[string]float64{
+			"{host=stable}": .5,
+			"{host=mixed}":  2.0 / 6,
+			"{host=off}":    0,
+			"{host=nan}":    math.NaN(),
+		}},
+		{expr: `in_band("sum:m{host=*}", "1h", 50, -1)`, err: "in_band: tolerance must not be negative"},
+	})
+}
+
+func TestDynThreshold(t *testing.T) {
+	// 2, 4, 4, 4, 5, 5, 7, 9 has mean 5 and sample standard deviation
+	// sqrt(32/7).
+	sd := math.Sqrt(32.0 / 7)
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=a", 60, 2, 4, 4, 4, math.NaN(), 5, 5, 7, 9),
+			response("host=flat", 60, 3, 3, 3),
+			response("host=one", 60, 3, math.NaN()),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `dyn_threshold("sum:m{host=*}", "1h", 3)`, output: map[string]float64{
+			"{host=a}":    5 + 3*sd,
+			"{host=flat}": 3,
+			"{host=one}":  math.NaN(),
+		}},
+		{expr: `dyn_threshold("sum:m{host=*}", "1h", -1)`, output: map[string]float64{
+			"{host=a}":    5 - sd,
+			"{host=flat}": 3,
+			"{host=one}":  math.NaN(),
+		}},
+		{expr: `last(q("sum:m{host=*}", "1h", "")) > dyn_threshold("sum:m{host=*}", "1h", 1)`, output: map[string]float64{
+			"{host=a}":    1,
+			"{host=flat}": 0,
+			"{host=one}":  math.NaN(),
+		}},
+	})
+}
+
+func TestRateRatio(t *testing.T) {
+	// Counters sampled every minute over the last 10 minutes.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"requests": {
+			// 10/s throughout.
+			response("host=steady", 60, 0, 600, 1200, 1800, 2400, 3000, 3600, 4200, 4800, 5400),
+			// 10/s, then 40/s over the last 3 minutes.
+			response("host=spike", 60, 0, 600, 1200, 1800, 2400, 3000, 3600, 6000, 8400, 10800),
+			// Reset three minutes ago, followed by the same 10/s.
+			response("host=reset", 60, 0, 600, 1200, 1800, 2400, 3000, 3600, 600, 1200, 1800),
+			response("host=idle", 60, 5, 5, 5, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `rate_ratio("sum:requests{host=*}", "3m", "1h")`, output: map[string]float64{
+			"{host=steady}": 1,
+			"{host=spike}":  40 / (10800.0 / 540),
+			"{host=reset}":  (1200.0 / 120) / (5400.0 / 540),
+			"{host=idle}":   math.NaN(),
+		}},
+		{expr: `rate_ratio("sum:requests{host=*}", "3m", "1h") > 1.5`, output: map[string]float64{
+			"{host=steady}": 0,
+			"{host=spike}":  1,
+			"{host=reset}":  0,
+			"{host=idle}":   math.NaN(),
+		}},
+		{expr: `rate_ratio("sum:requests{host=*}", "2h", "1h")`, err: "rate_ratio: current duration 2h is longer than baseline duration 1h"},
+	})
+}
+
+func TestSeriesDiff(t *testing.T) {
+	// b is missing a's first point and has an extra point before a starts,
+	// so only the last three timestamps are compared.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"a": {
+			response("host=x", 60, 100, 10, 20, 30),
+			response("host=y", 60, 1, 2),
+		},
+		"b": {
+			shifted(response("host=x", 60, 50), 4*time.Minute, response("host=x", 60, 4, 8, 36)),
+			shifted(response("host=y", 60, 1, 2), time.Hour),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `series_diff(pairs("sum:a{host=*}", "sum:b{host=*}", "1h"), "avg")`, output: map[string]float64{
+			"{host=x}": 4,
+			"{host=y}": math.NaN(),
+		}},
+		{expr: `series_diff(pairs("sum:a{host=*}", "sum:b{host=*}", "1h"), "max")`, output: map[string]float64{
+			"{host=x}": 12,
+			"{host=y}": math.NaN(),
+		}},
+		{expr: `series_diff(pairs("sum:a{host=*}", "sum:b{host=*}", "1h"), "last")`, output: map[string]float64{
+			"{host=x}": -6,
+			"{host=y}": math.NaN(),
+		}},
+		{expr: `series_diff(pairs("sum:a{host=*}", "sum:b{host=*}", "1h"), "median")`, err: `series_diff: unknown aggregator "median"`},
+	})
+}
+
+func TestMissingGroups(t *testing.T) {
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"inventory": {
+			response("host=a", 60, 1),
+			response("host=b", 60, 1),
+			response("host=c", 60, 1),
+			response("host=d", 60, 1),
+		},
+		"cpu": {
+			response("host=a", 60, 10, 20),
+			response("host=c", 60, 5),
+			// Stopped reporting before the window.
+			shifted(response("host=d", 60, 5), 2*time.Hour),
+			// Not in the inventory, so not counted either way.
+			response("host=e", 60, 5),
+		},
+		"all": {
+			response("host=a", 60, 1),
+			response("host=b", 60, 1),
+			response("host=c", 60, 1),
+			response("host=d", 60, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `missing_groups("sum:cpu{host=*}", "1h", "sum:inventory{host=*}")`, output: map[string]float64{
+			"{}": 2,
+		}},
+		{expr: `missing_groups("sum:all{host=*}", "1h", "sum:inventory{host=*}")`, output: map[string]float64{
+			"{}": 0,
+		}},
+		{expr: `missing_groups("sum:cpu{host=*}", "1h", "sum:inventory{host=*}") > 0`, output: map[string]float64{
+			"{}": 1,
+		}},
+	})
+}
+
+func TestRateBudget(t *testing.T) {
+	// Minutely counters over the last 10 minutes. The per-interval rates of
+	// host=busy are 1, 2, 1, 2, 1, 2, 1, then 5 and 5, so its p90 is 5 and its
+	// median is 2, and its rate over the last 3 minutes is 5. host=quiet
+	// runs at 1 over the same period, the median of its rates, but below its
+	// p90 of 2.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"requests": {
+			response("host=busy", 60, 0, 60, 180, 240, 360, 420, 540, 600, 900, 1200),
+			response("host=quiet", 60, 0, 60, 180, 240, 360, 420, 540, 600, 660, 720),
+			response("host=idle", 60, 5),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `rate_budget("sum:requests{host=*}", "3m", "1h", .5)`, output: map[string]float64{
+			"{host=busy}":  5 - 2,
+			"{host=quiet}": 0,
+			"{host=idle}":  math.NaN(),
+		}},
+		{expr: `rate_budget("sum:requests{host=*}", "3m", "1h", .9)`, output: map[string]float64{
+			"{host=busy}":  0,
+			"{host=quiet}": 1 - 2,
+			"{host=idle}":  math.NaN(),
+		}},
+		{expr: `rate_budget("sum:requests{host=*}", "3m", "1h", .5) > 0`, output: map[string]float64{
+			"{host=busy}":  1,
+			"{host=quiet}": 0,
+			"{host=idle}":  math.NaN(),
+		}},
+		{expr: `rate_budget("sum:requests{host=*}", "2h", "1h", .5)`, err: "rate_budget: duration 2h is longer than baseline duration 1h"},
+	})
+}
+
+func TestAtOffset(t *testing.T) {
+	nan := math.NaN()
+	// Points are 1 to 10 minutes before testNow, with the value at n minutes
+	// being n, apart from host=gap which has nothing between 3 and 8 minutes.
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"m": {
+			response("host=all", 60, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1),
+			response("host=gap", 60, 10, 9, 8, nan, nan, nan, nan, 3, 2, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `at_offset("sum:m{host=*}", "1h", "5m", "30s")`, output: map[string]float64{
+			"{host=all}": 5,
+			"{host=gap}": math.NaN(),
+		}},
+		// 4m30s is equally near 4 and 5 minutes; the later point wins.
+		{expr: `at_offset("sum:m{host=*}", "1h", "270s", "1m")`, output: map[string]float64{
+			"{host=all}": 4,
+			"{host=gap}": math.NaN(),
+		}},
+		{expr: `at_offset("sum:m{host=*}", "1h", "5m", "3m")`, output: map[string]float64{
+			"{host=all}": 5,
+			"{host=gap}": 3,
+		}},
+		{expr: `at_offset("sum:m{host=*}", "1h", "0s", "1m")`, output: map[string]float64{
+			"{host=all}": 1,
+			"{host=gap}": 1,
+		}},
+		{expr: `at_offset("sum:m{host=*}", "1h", "5m", "-1m")`, err: "at_offset: offset and tolerance must not be negative"},
+	})
+}
+
+func TestAboveRatio(t *testing.T) {
+	nan := math.NaN()
+	c := &testContext{responses: map[string]opentsdb.ResponseSet{
+		"errors": {
+			// 3 + 3 breaches in ny, 2 in la and none in sf.
+			response("dc=ny,host=a", 60, 9, 1, 9, 9),
+			response("dc=ny,host=b", 60, 6, 7, 8, nan),
+			response("dc=la,host=c", 60, 1, 9, 1, 9),
+			response("dc=sf,host=d", 60, 1, 5, 1),
+		},
+	}}
+	testFuncs(t, c, []funcTest{
+		{expr: `above_ratio("sum:errors{dc=*,host=*}", "1h", 5, "dc", "ny", "la")`, output: map[string]float64{
+			"{}": 3,
+		}},
+		{expr: `above_ratio("sum:errors{dc=*,host=*}", "1h", 5, "dc", "la", "ny")`, output: map[string]float64{
+			"{}": 1.0 / 3,
+		}},
+		{expr: `above_ratio("sum:errors{dc=*,host=*}", "1h", 5, "dc", "sf", "la")`, output: map[string]float64{
+			"{}": 0,
+		}},
+		{expr: `above_ratio("sum:errors{dc=*,host=*}", "1h", 5, "dc", "ny", "sf")`, output: map[string]float64{
+			"{}": math.NaN(),
+		}},
+		{expr: `above_ratio("sum:errors{dc=*,host=*}", "1h", 5, "dc", "ny", "tx")`, output: map[string]float64{
+			"{}": math.NaN(),
+		}},
+	})
+}
@@ -328,7 +328,7 @@ func processBucketItem(b *elastic.AggregationBucketHistogramItem, rstat string,
 
 // LSBaseQuery builds the base query that both LSCount and LSStat share
 func LSBaseQuery(now time.Time, indexRoot string, l LogstashElasticHosts, keystring string, filter, sduration, eduration string, size int) (*LogstashRequest, error) {
-	start, err := opentsdb.ParseDuration(sduration)
+	start, err := windowDuration("logstash", sduration)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +53,8 @@ const (
 	itemComma
 	itemLeftParen
 	itemRightParen
+	itemLeftBracket
+	itemRightBracket
 	itemString
 	itemFunc
 )
@@ -179,6 +181,10 @@ Loop:
 			l.emit(itemLeftParen)
 		case r == ')':
 			l.emit(itemRightParen)
+		case r == '[':
+			l.emit(itemLeftBracket)
+		case r == ']':
+			l.emit(itemRightBracket)
 		case r == '"':
 			return lexString
 		case r == ',':
@@ -265,7 +271,7 @@ func lexSymbol(l *lexer) stateFn {
 func lexFunc(l *lexer) stateFn {
 	for {
 		switch r := l.next(); {
-		case unicode.IsLetter(r):
+		case isVarchar(r):
 			// absorb
 		default:
 			l.backup()
@@ -11,27 +11,29 @@ import (
 
 // Make the types prettyprint.
 var itemName = map[itemType]string{
-	itemError:      "error",
-	itemEOF:        "EOF",
-	itemNot:        "!",
-	itemAnd:        "&&",
-	itemOr:         "||",
-	itemGreater:    ">",
-	itemLess:       "<",
-	itemGreaterEq:  ">=",
-	itemLessEq:     "<=",
-	itemEq:         "==",
-	itemNotEq:      "!=",
-	itemPlus:       "+",
-	itemMinus:      "-",
-	itemMult:       "*",
-	itemDiv:        "/",
-	itemNumber:     "number",
-	itemComma:      ",",
-	itemLeftParen:  "(",
-	itemRightParen: ")",
-	itemString:     "string",
-	itemFunc:       "func",
+	itemError:        "error",
+	itemEOF:          "EOF",
+	itemNot:          "!",
+	itemAnd:          "&&",
+	itemOr:           "||",
+	itemGreater:      ">",
+	itemLess:         "<",
+	itemGreaterEq:    ">=",
+	itemLessEq:       "<=",
+	itemEq:           "==",
+	itemNotEq:        "!=",
+	itemPlus:         "+",
+	itemMinus:        "-",
+	itemMult:         "*",
+	itemDiv:          "/",
+	itemNumber:       "number",
+	itemComma:        ",",
+	itemLeftParen:    "(",
+	itemRightParen:   ")",
+	itemLeftBracket:  "[",
+	itemRightBracket: "]",
+	itemString:       "string",
+	itemFunc:         "func",
 }
 
 func (i itemType) String() string {
@@ -123,6 +125,20 @@ var lexTests = []lexTest{
 		{itemNumber, 0, "0.4"},
 		tEOF,
 	}},
+	{"func names", "avg pct_change r2", []item{
+		{itemFunc, 0, "avg"},
+		{itemFunc, 0, "pct_change"},
+		{itemFunc, 0, "r2"},
+		tEOF,
+	}},
+	{"list", `[1, "a"]`, []item{
+		{itemLeftBracket, 0, "["},
+		{itemNumber, 0, "1"},
+		tComma,
+		{itemString, 0, `"a"`},
+		{itemRightBracket, 0, "]"},
+		tEOF,
+	}},
 	// errors
 	{"unclosed quote", "\"", []item{
 		{itemError, 0, "unterminated string"},
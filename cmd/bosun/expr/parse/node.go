@@ -56,6 +56,8 @@ const (
 	NodeUnary                  // Unary operator: !, -
 	NodeString                 // A string constant.
 	NodeNumber                 // A numerical constant.
+	NodeList                   // A list of constants.
+	NodeConst                  // A named constant.
 )
 
 // Nodes.
@@ -227,6 +229,86 @@ func (s *StringNode) Tags() (Tags, error) {
 	return nil, nil
 }
 
+// ConstNode holds a named constant, whose value is supplied when the
+// expression is executed.
+type ConstNode struct {
+	NodeType
+	Pos
+	Name string
+}
+
+func newConst(pos Pos, name string) *ConstNode {
+	return &ConstNode{NodeType: NodeConst, Pos: pos, Name: name}
+}
+
+func (c *ConstNode) String() string {
+	return c.Name
+}
+
+func (c *ConstNode) StringAST() string {
+	return c.String()
+}
+
+func (c *ConstNode) Check() error {
+	return nil
+}
+
+func (c *ConstNode) Return() FuncType {
+	return TypeScalar
+}
+
+func (c *ConstNode) Tags() (Tags, error) {
+	return nil, nil
+}
+
+// ListNode holds a list of number or string constants.
+type ListNode struct {
+	NodeType
+	Pos
+	Items []Node // Each item is a *NumberNode or a *StringNode.
+}
+
+func newList(pos Pos) *ListNode {
+	return &ListNode{NodeType: NodeList, Pos: pos}
+}
+
+func (l *ListNode) append(n Node) {
+	l.Items = append(l.Items, n)
+}
+
+func (l *ListNode) String() string {
+	s := "["
+	for i, n := range l.Items {
+		if i > 0 {
+			s += ", "
+		}
+		s += n.String()
+	}
+	s += "]"
+	return s
+}
+
+func (l *ListNode) StringAST() string {
+	return l.String()
+}
+
+func (l *ListNode) Check() error {
+	for _, n := range l.Items {
+		if n.Type() != l.Items[0].Type() {
+			return fmt.Errorf("parse: mixed item types in list %s", l)
+		}
+	}
+	return nil
+}
+
+func (l *ListNode) Return() FuncType {
+	return TypeList
+}
+
+func (l *ListNode) Tags() (Tags, error) {
+	return nil, nil
+}
+
 // BinaryNode holds two arguments and an operator.
 type BinaryNode struct {
 	NodeType
@@ -245,12 +327,19 @@ func (b *BinaryNode) String() string {
 }
 
 func (b *BinaryNode) StringAST() string {
-	return fmt.Sprintf("%s(%s, %s)", b.Operator.val, b.Args[0], b.Args[1])
+	return fmt.Sprintf("%s(%s, %s)", b.Operator.val, b.Args[0].StringAST(), b.Args[1].StringAST())
 }
 
 func (b *BinaryNode) Check() error {
 	t1 := b.Args[0].Return()
 	t2 := b.Args[1].Return()
+	for _, t := range []FuncType{t1, t2} {
+		switch t {
+		case TypeNumber, TypeScalar, TypeSeries:
+		default:
+			return fmt.Errorf("parse: type error in %s: expected a number", b)
+		}
+	}
 	if t1 == TypeSeries && t2 == TypeSeries {
 		return fmt.Errorf("parse: type error in %s: at least one side must be a number", b)
 	}
@@ -319,7 +408,7 @@ func (u *UnaryNode) String() string {
 }
 
 func (u *UnaryNode) StringAST() string {
-	return fmt.Sprintf("%s(%s)", u.Operator.val, u.Arg)
+	return fmt.Sprintf("%s(%s)", u.Operator.val, u.Arg.StringAST())
 }
 
 func (u *UnaryNode) Check() error {
@@ -350,7 +439,11 @@ func Walk(n Node, f func(Node)) {
 		for _, a := range n.Args {
 			Walk(a, f)
 		}
-	case *NumberNode, *StringNode:
+	case *ListNode:
+		for _, a := range n.Items {
+			Walk(a, f)
+		}
+	case *ConstNode, *NumberNode, *StringNode:
 		// Ignore.
 	case *UnaryNode:
 		Walk(n.Arg, f)
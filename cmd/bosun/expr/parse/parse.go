@@ -19,6 +19,9 @@ import (
 type Tree struct {
 	Text string // text parsed to create the expression.
 	Root Node   // top-level root of the tree, returns a number.
+	// Consts are the names that may be used as named constants. Any other
+	// name not followed by "(" is reported as an unknown function.
+	Consts map[string]bool
 	// Parsing only; cleared after parse.
 	funcs     []map[string]Func
 	lex       *lexer
@@ -45,6 +48,10 @@ func (f FuncType) String() string {
 		return "series"
 	case TypeScalar:
 		return "scalar"
+	case TypeList:
+		return "list"
+	case TypePairs:
+		return "pairs"
 	default:
 		return "unknown"
 	}
@@ -55,6 +62,8 @@ const (
 	TypeScalar
 	TypeNumber
 	TypeSeries
+	TypeList
+	TypePairs
 )
 
 type Tags map[string]struct{}
@@ -203,7 +212,7 @@ func (t *Tree) startParse(funcs []map[string]Func, lex *lexer) {
 	for _, funcMap := range funcs {
 		for name, f := range funcMap {
 			switch f.Return {
-			case TypeSeries, TypeNumber:
+			case TypeSeries, TypeNumber, TypePairs:
 				if f.Tags == nil {
 					panic(fmt.Errorf("%v: expected Tags definition: got nil", name))
 				}
@@ -247,12 +256,15 @@ func (t *Tree) parse() {
 O -> A {"||" A}
 A -> C {"&&" C}
 C -> P {( "==" | "!=" | ">" | ">=" | "<" | "<=") P}
+	(a chain of ">", ">=", "<" and "<=", as in a < b < c, means a < b && b < c)
 P -> M {( "+" | "-" ) M}
 M -> F {( "*" | "/" ) F}
 F -> v | "(" O ")" | "!" O | "-" O
-v -> number | func(..)
+v -> number | func(..) | name
 Func -> name "(" param {"," param} ")"
-param -> number | "string" | [query]
+param -> number | "string" | list | [query]
+list -> "[" [item {"," item}] "]"
+item -> number | "string"
 */
 
 // expr:
@@ -282,10 +294,23 @@ func (t *Tree) A() Node {
 
 func (t *Tree) C() Node {
 	n := t.P()
+	// last is the right operand of the preceding relational operator, if any.
+	var last Node
 	for {
 		switch t.peek().typ {
-		case itemEq, itemNotEq, itemGreater, itemGreaterEq, itemLess, itemLessEq:
+		case itemGreater, itemGreaterEq, itemLess, itemLessEq:
+			op := t.next()
+			r := t.P()
+			if last == nil {
+				n = newBinary(op, n, r)
+			} else {
+				// Chained comparisons: a < b < c is a < b && b < c.
+				n = newBinary(item{itemAnd, op.pos, "&&"}, n, newBinary(op, last, r))
+			}
+			last = r
+		case itemEq, itemNotEq:
 			n = newBinary(t.next(), n, t.P())
+			last = nil
 		default:
 			return n
 		}
@@ -342,8 +367,10 @@ func (t *Tree) v() Node {
 		}
 		return n
 	case itemFunc:
-		t.backup()
-		return t.Func()
+		if t.peek().typ != itemLeftParen && t.Consts[token.val] {
+			return newConst(token.pos, token.val)
+		}
+		return t.function(token)
 	default:
 		t.unexpected(token, "input")
 	}
@@ -351,10 +378,14 @@ func (t *Tree) v() Node {
 }
 
 func (t *Tree) Func() (f *FuncNode) {
-	token := t.next()
+	return t.function(t.next())
+}
+
+// function parses the call of the function named by token.
+func (t *Tree) function(token item) (f *FuncNode) {
 	funcv, ok := t.getFunction(token.val)
 	if !ok {
-		t.errorf("non existent function %s", token.val)
+		t.errorf("unknown function '%s' at position %d", token.val, token.pos+1)
 	}
 	f = newFunc(token.pos, token.val, funcv)
 	t.expect(itemLeftParen, "func")
@@ -364,11 +395,10 @@ func (t *Tree) Func() (f *FuncNode) {
 			t.backup()
 			f.append(t.O())
 		case itemString:
-			s, err := strconv.Unquote(token.val)
-			if err != nil {
-				t.error(err)
-			}
-			f.append(newString(token.pos, token.val, s))
+			f.append(t.stringNode(token))
+		case itemLeftBracket:
+			t.backup()
+			f.append(t.List())
 		case itemRightParen:
 			return
 		}
@@ -383,6 +413,49 @@ func (t *Tree) Func() (f *FuncNode) {
 	}
 }
 
+// List parses a bracketed, comma-separated list of number and string literals.
+func (t *Tree) List() (l *ListNode) {
+	token := t.expect(itemLeftBracket, "list")
+	l = newList(token.pos)
+	for {
+		switch token = t.next(); token.typ {
+		case itemNumber:
+			n, err := newNumber(token.pos, token.val)
+			if err != nil {
+				t.error(err)
+			}
+			l.append(n)
+		case itemString:
+			l.append(t.stringNode(token))
+		case itemLeftBracket:
+			t.errorf("nested lists are not supported at position %d", token.pos+1)
+		case itemRightBracket:
+			if len(l.Items) == 0 {
+				return
+			}
+			t.unexpected(token, "list")
+		default:
+			t.unexpected(token, "list")
+		}
+		switch token = t.next(); token.typ {
+		case itemComma:
+			// continue
+		case itemRightBracket:
+			return
+		default:
+			t.unexpected(token, "list")
+		}
+	}
+}
+
+func (t *Tree) stringNode(token item) *StringNode {
+	s, err := strconv.Unquote(token.val)
+	if err != nil {
+		t.error(err)
+	}
+	return newString(token.pos, token.val, s)
+}
+
 func (t *Tree) getFunction(name string) (v Func, ok bool) {
 	for _, funcMap := range t.funcs {
 		if funcMap == nil {
@@ -107,6 +107,14 @@ var parseTests = []parseTest{
 	{"unary series", `!q("q", "1m")`, noError, `!q("q", "1m")`},
 	{"expr in func", `forecastlr(q("q", "1m"), -1)`, noError, `forecastlr(q("q", "1m"), -1)`},
 	{"nested func expr", `avg(q("q","1m")>0)`, noError, `avg(q("q", "1m") > 0)`},
+	{"chained comparison", "1 < 2 <= 3", noError, "1 < 2 && 2 <= 3"},
+	{"long chained comparison", "1 < 2 < 3 > 0", noError, "1 < 2 && 2 < 3 && 3 > 0"},
+	{"equality not chained", "1 < 2 == 1", noError, "1 < 2 == 1"},
+	{"list", `list([1,2, 3])`, noError, `list([1, 2, 3])`},
+	{"empty list", `list([])`, noError, `list([])`},
+	{"string list", `list(["a", "b"])`, noError, `list(["a", "b"])`},
+	{"constant", `avg(q("q", "1m")) > threshold*2`, noError, `avg(q("q", "1m")) > threshold * 2`},
+	{"constant func arg", `forecastlr(q("q", "1m"), limit)`, noError, `forecastlr(q("q", "1m"), limit)`},
 	// Errors.
 	{"empty", "", hasError, ""},
 	{"unclosed function", "avg(", hasError, ""},
@@ -114,6 +122,13 @@ var parseTests = []parseTest{
 	{"bad type", `band("q", "1h", "1m", "8")`, hasError, ""},
 	{"wrong number args", `avg(q("q", "1m"), "1m", 1)`, hasError, ""},
 	{"2 series math", `band(q("q", "1m"))+band(q("q", "1m"))`, hasError, ""},
+	{"nested list", `list([1, [2]])`, hasError, ""},
+	{"mixed list", `list([1, "a"])`, hasError, ""},
+	{"unclosed list", `list([1, 2)`, hasError, ""},
+	{"trailing comma list", `list([1,])`, hasError, ""},
+	{"list math", `list([1]) + [1]`, hasError, ""},
+	{"list not func arg", `avg([1])`, hasError, ""},
+	{"constant as series", `avg(threshold)`, hasError, ""},
 }
 
 func TestParse(t *testing.T) {
@@ -121,6 +136,7 @@ func TestParse(t *testing.T) {
 	defer func() { textFormat = "%s" }()
 	for _, test := range parseTests {
 		tmpl := New(nil)
+		tmpl.Consts = map[string]bool{"threshold": true, "limit": true}
 		err := tmpl.Parse(test.input, builtins)
 		switch {
 		case err == nil && !test.ok:
@@ -144,6 +160,45 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseList(t *testing.T) {
+	tree, err := Parse(`list([1, 2.5, 3])`, builtins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := tree.Root.(*FuncNode).Args[0].(*ListNode)
+	if !ok {
+		t.Fatalf("expected a list, got %T", tree.Root.(*FuncNode).Args[0])
+	}
+	var got []float64
+	for _, n := range l.Items {
+		got = append(got, n.(*NumberNode).Float64)
+	}
+	if want := []float64{1, 2.5, 3}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if _, err := Parse(`list([[1]])`, builtins); err == nil || err.Error() != "expr: nested lists are not supported at position 7" {
+		t.Errorf("expected nested list error, got %v", err)
+	}
+}
+
+func TestParseUnknownFunction(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`agv(q("q", "1m"))`, "expr: unknown function 'agv' at position 1"},
+		{`avg(qq("q", "1m"))`, "expr: unknown function 'qq' at position 5"},
+		{"1 + sum(1)", "expr: unknown function 'sum' at position 5"},
+		{`avg(q("q", "1m")) > threshhold`, "expr: unknown function 'threshhold' at position 21"},
+	}
+	for _, test := range tests {
+		err := New(nil).Parse(test.input, builtins)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %v", test.input, test.err, err)
+		}
+	}
+}
+
 func tagNil(args []Node) (Tags, error) {
 	return nil, nil
 }
@@ -173,4 +228,10 @@ var builtins = map[string]Func{
 		tagNil,
 		nil,
 	},
+	"list": {
+		[]FuncType{TypeList},
+		TypeScalar,
+		nil,
+		nil,
+	},
 }
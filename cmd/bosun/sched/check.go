@@ -10,6 +10,7 @@ import (
 	"bosun.org/cmd/bosun/cache"
 	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/expr"
+	"bosun.org/cmd/bosun/expr/parse"
 	"bosun.org/collect"
 	"bosun.org/graphite"
 	"bosun.org/opentsdb"
@@ -52,12 +53,14 @@ func (rh *RunHistory) AtTime(t time.Time) *RunHistory {
 	return &n
 }
 
-func (s *Schedule) NewRunHistory(start time.Time, cache *cache.Cache) *RunHistory {
+// NewRunHistory returns a RunHistory starting at start. Closing cancel, if non
+// nil, stops pending OpenTSDB retries made through its context.
+func (s *Schedule) NewRunHistory(start time.Time, cache *cache.Cache, cancel <-chan struct{}) *RunHistory {
 	return &RunHistory{
 		Cache:           cache,
 		Start:           start,
 		Events:          make(map[expr.AlertKey]*Event),
-		Context:         s.Conf.TSDBContext(),
+		Context:         s.Conf.TSDBContext(cancel),
 		GraphiteContext: s.Conf.GraphiteContext(),
 		Logstash:        s.Conf.LogstashElasticHosts,
 	}
@@ -213,12 +216,34 @@ func (s *Schedule) Check(T miniprofiler.Timer, now time.Time) (time.Duration, er
 	default:
 		return 0, fmt.Errorf("check already running")
 	}
-	r := s.NewRunHistory(now, cache.New(0))
+	// Retrying a failing OpenTSDB must not make the check outlast its
+	// interval, so pending retries are abandoned once it has passed.
+	cancel := make(chan struct{})
+	if s.Conf.CheckFrequency > 0 {
+		timer := time.AfterFunc(s.Conf.CheckFrequency, func() { close(cancel) })
+		defer timer.Stop()
+	}
+	r := s.NewRunHistory(now, cache.New(0), cancel)
+	// Evaluating against an unreachable backend would only produce spurious
+	// results, so alerts querying OpenTSDB are skipped while it is down.
+	tsdbDown := false
+	if p, ok := r.Context.(opentsdb.Pinger); ok {
+		if err := p.Ping(); err != nil {
+			log.Printf("check: skipping OpenTSDB alerts: %v", err)
+			tsdbDown = true
+		}
+	}
 	start := time.Now()
 	for _, ak := range s.findUnknownAlerts(now) {
 		r.Events[ak] = &Event{Status: StUnknown}
 	}
 	for _, a := range s.Conf.OrderedAlerts {
+		if tsdbDown && s.usesTSDB(a, nil) {
+			// As when its query fails, the alert's groups must not go
+			// unknown because the backend is down.
+			removeUnknownEvents(r.Events, a.Name)
+			continue
+		}
 		s.CheckAlert(T, r, a)
 	}
 	d := time.Since(start)
@@ -227,6 +252,42 @@ func (s *Schedule) Check(T miniprofiler.Timer, now time.Time) (time.Duration, er
 	return d, nil
 }
 
+// usesTSDB reports whether any of a's expressions, or those of the alerts
+// they evaluate with alert(), call an OpenTSDB function. seen holds the alerts
+// already visited.
+func (s *Schedule) usesTSDB(a *conf.Alert, seen map[string]bool) bool {
+	if seen == nil {
+		seen = make(map[string]bool)
+	}
+	if a == nil || seen[a.Name] {
+		return false
+	}
+	seen[a.Name] = true
+	found := false
+	for _, e := range []*expr.Expr{a.Crit, a.Warn, a.Depends} {
+		if e == nil {
+			continue
+		}
+		parse.Walk(e.Tree.Root, func(n parse.Node) {
+			f, ok := n.(*parse.FuncNode)
+			if !ok || found {
+				return
+			}
+			if _, ok := expr.TSDB[f.Name]; ok {
+				found = true
+			} else if f.Name == "alert" && len(f.Args) > 0 {
+				if name, ok := f.Args[0].(*parse.StringNode); ok {
+					found = s.usesTSDB(s.Conf.Alerts[name.Text], seen)
+				}
+			}
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
 var bosunStartupTime = time.Now()
 
 func (s *Schedule) findUnknownAlerts(now time.Time) []expr.AlertKey {
@@ -338,7 +399,8 @@ func (s *Schedule) executeExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Ale
 	if e == nil {
 		return nil, nil
 	}
-	results, _, err := e.Execute(rh.Context, rh.GraphiteContext, rh.Logstash, rh.Cache, T, rh.Start, 0, a.UnjoinedOK, s.Search, s.Conf.AlertSquelched(a), rh)
+	key := a.Name + " " + e.String()
+	results, _, next, err := e.ExecuteWithPrior(s.persisted[key], rh.Context, rh.GraphiteContext, rh.Logstash, rh.Cache, T, rh.Start, 0, a.UnjoinedOK, s.Search, s.Conf.AlertSquelched(a), rh)
 	if err != nil {
 		ak := expr.NewAlertKey(a.Name, nil)
 		state := s.Status(ak)
@@ -358,6 +420,11 @@ func (s *Schedule) executeExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Ale
 		}
 		return nil, err
 	}
+	if len(next) > 0 {
+		s.persisted[key] = next
+	} else {
+		delete(s.persisted, key)
+	}
 	return results, err
 }
 
@@ -258,3 +258,43 @@ Loop:
 		t.Errorf("didn't get expected result")
 	}
 }
+
+func TestCheckPersisted(t *testing.T) {
+	value := 5
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/version" {
+			return
+		}
+		fmt.Fprintf(w, `[{"metric":"m","tags":{"a":"b"},"dps":{"0":%d}}]`, value)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert a {
+			warn = persisted_max(avg(q("avg:m{a=*}", "5m", ""))) > 3
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	s := new(Schedule)
+	if err := s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	ak := expr.NewAlertKey("a", opentsdb.TagSet{"a": "b"})
+	// The second check's value is below the threshold, but persisted_max
+	// keeps the first check's.
+	for _, value = range []int{5, 1} {
+		if _, err := s.Check(nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if st := s.Status(ak).Status(); st != StWarning {
+			t.Fatalf("value %d: expected %v, got %v", value, StWarning, st)
+		}
+	}
+}
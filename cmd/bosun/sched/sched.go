@@ -47,6 +47,9 @@ type Schedule struct {
 	metalock      sync.Mutex
 	checkRunning  chan bool
 	db            *bolt.DB
+	// persisted holds the state that functions such as persisted_avg carry
+	// from one check to the next, keyed by alert name and expression.
+	persisted map[string]expr.PersistedState
 }
 
 func (s *Schedule) TimeLock(t miniprofiler.Timer) {
@@ -375,6 +378,7 @@ func (s *Schedule) Init(c *conf.Conf) error {
 	s.status = make(States)
 	s.Search = search.NewSearch()
 	s.checkRunning = make(chan bool, 1)
+	s.persisted = make(map[string]expr.PersistedState)
 	if c.StateFile != "" {
 		s.db, err = bolt.Open(c.StateFile, 0600, nil)
 		if err != nil {
@@ -31,11 +31,19 @@ type schedTest struct {
 	// state -> active
 	state    map[schedState]bool
 	previous map[expr.AlertKey]*State
+	// tsdbDown makes the OpenTSDB server fail the scheduler's ping.
+	tsdbDown bool
 }
 
 func testSched(t *testing.T, st *schedTest) (s *Schedule) {
 	bosunStartupTime = time.Date(1900, 0, 0, 0, 0, 0, 0, time.UTC) //pretend we've been running for a while.
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/version" {
+			if st.tsdbDown {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return // Answer the scheduler's ping.
+		}
 		var req opentsdb.Request
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			log.Fatal(err)
@@ -231,6 +239,32 @@ func TestUnknown_WithError(t *testing.T) {
 	})
 }
 
+func TestTSDBDown(t *testing.T) {
+	state := NewStatus("a{a=b}")
+	state.Touched = queryTime.Add(-10 * time.Minute)
+	state.Append(&Event{Status: StNormal, Time: state.Touched})
+
+	testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:m{a=*}", "5m", "")) > 0
+		}
+		alert b {
+			crit = alert("a", "crit")
+		}
+		alert c {
+			crit = 1
+		}`,
+		queries: map[string]opentsdb.ResponseSet{},
+		state: map[schedState]bool{
+			schedState{"c{}", "critical"}: true,
+		},
+		previous: map[expr.AlertKey]*State{
+			"a{a=b}": state,
+		},
+		tsdbDown: true,
+	})
+}
+
 func TestError_To_Unknown(t *testing.T) {
 	ak := expr.NewAlertKey("a", nil)
 	state := NewStatus(ak)
@@ -37,7 +37,7 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 		return nil, err
 	}
 	// it may not strictly be necessary to recreate the contexts each time, but we do to be safe
-	tsdbContext := schedule.Conf.TSDBContext()
+	tsdbContext := schedule.Conf.TSDBContext(nil)
 	graphiteContext := schedule.Conf.GraphiteContext()
 	ls := schedule.Conf.LogstashElasticHosts
 	res, queries, err := e.Execute(tsdbContext, graphiteContext, ls, cacheObj, t, now, 0, false, schedule.Search, nil, nil)
@@ -91,7 +91,7 @@ func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time,
 	}
 	s.Metadata = schedule.Metadata
 	s.Search = schedule.Search
-	rh := s.NewRunHistory(now, cacheObj)
+	rh := s.NewRunHistory(now, cacheObj, nil)
 	if _, err := s.CheckExpr(t, rh, a, a.Warn, sched.StWarning, nil); err != nil {
 		return nil, err
 	}
@@ -10,12 +10,14 @@ import (
 	"io/ioutil"
 	"math"
 	"math/big"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -39,10 +41,53 @@ type Point float64
 // Response is a query response:
 // http://opentsdb.net/docs/build/html/api_http/query/index.html#response.
 type Response struct {
-	Metric        string           `json:"metric"`
-	Tags          TagSet           `json:"tags"`
-	AggregateTags []string         `json:"aggregateTags"`
-	DPS           map[string]Point `json:"dps"`
+	Metric        string   `json:"metric"`
+	Tags          TagSet   `json:"tags"`
+	AggregateTags []string `json:"aggregateTags"`
+	DPS           DPS      `json:"dps"`
+}
+
+// DPS holds the data points of a Response, keyed by Unix timestamp.
+type DPS map[string]Point
+
+// UnmarshalJSON decodes the dps object of a Response. OpenTSDB can return the
+// same timestamp more than once; such points are averaged instead of the last
+// one silently replacing the others.
+func (d *DPS) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		*d = nil
+		return nil
+	}
+	if t != json.Delim('{') {
+		return fmt.Errorf("opentsdb: expected dps object, got %v", t)
+	}
+	dps := make(DPS)
+	counts := make(map[string]int)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		k := t.(string)
+		var p Point
+		if err := dec.Decode(&p); err != nil {
+			return err
+		}
+		dps[k] += p
+		counts[k]++
+	}
+	for k, n := range counts {
+		if n > 1 {
+			dps[k] /= Point(n)
+		}
+	}
+	*d = dps
+	return nil
 }
 
 func (r *Response) Copy() *Response {
@@ -50,7 +95,7 @@ func (r *Response) Copy() *Response {
 	newR.Metric = r.Metric
 	newR.Tags = r.Tags.Copy()
 	copy(newR.AggregateTags, r.AggregateTags)
-	newR.DPS = map[string]Point{}
+	newR.DPS = DPS{}
 	for k, v := range r.DPS {
 		newR.DPS[k] = v
 	}
@@ -734,11 +779,22 @@ func (r *Request) QueryResponse(host string, client *http.Client) (*http.Respons
 		if len(body) > 0 {
 			s = fmt.Sprintf("%s: %s", s, body)
 		}
-		return nil, errors.New(s)
+		return nil, &StatusError{Code: resp.StatusCode, Msg: s}
 	}
 	return resp, nil
 }
 
+// StatusError is the error for a non-OK response whose body was not an
+// OpenTSDB error structure.
+type StatusError struct {
+	Code int
+	Msg  string
+}
+
+func (s *StatusError) Error() string {
+	return s.Msg
+}
+
 // RequestError is the error structure for request errors.
 type RequestError struct {
 	Request string
@@ -758,6 +814,30 @@ type Context interface {
 	Query(*Request) (ResponseSet, error)
 }
 
+// Pinger is implemented by contexts which can check that their OpenTSDB
+// server is reachable.
+type Pinger interface {
+	Ping() error
+}
+
+// Ping checks that the OpenTSDB server at host is reachable and responding.
+func Ping(host string) error {
+	u := url.URL{
+		Scheme: "http",
+		Host:   host,
+		Path:   "/api/version",
+	}
+	resp, err := DefaultClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("opentsdb: ping %s: %s", host, resp.Status)
+	}
+	return nil
+}
+
 // Host is a simple OpenTSDB Context with no additional features.
 type Host string
 
@@ -766,6 +846,11 @@ func (h Host) Query(r *Request) (ResponseSet, error) {
 	return r.Query(string(h))
 }
 
+// Ping checks that the OpenTSDB server is reachable.
+func (h Host) Ping() error {
+	return Ping(string(h))
+}
+
 // LimitContext is a context that enables limiting response size and filtering tags
 type LimitContext struct {
 	Host string
@@ -808,6 +893,11 @@ func (c *LimitContext) Query(r *Request) (tr ResponseSet, err error) {
 	return
 }
 
+// Ping checks that the OpenTSDB server is reachable.
+func (c *LimitContext) Ping() error {
+	return Ping(c.Host)
+}
+
 // FilterTags removes tagks in tr not present in r. Does nothing in the event of
 // multiple queries in the request.
 func FilterTags(r *Request, tr ResponseSet) {
@@ -822,3 +912,159 @@ func FilterTags(r *Request, tr ResponseSet) {
 		}
 	}
 }
+
+// HostMode determines how a MultiContext uses its contexts.
+type HostMode int
+
+const (
+	// Failover queries each context in order until one succeeds.
+	Failover HostMode = iota
+	// FanOut queries all contexts and merges their responses.
+	FanOut
+)
+
+// MultiContext is a Context spanning several OpenTSDB servers, such as the
+// members of an HA setup.
+type MultiContext struct {
+	Contexts []Context
+	Mode     HostMode
+}
+
+// NewMultiContext returns a context querying the given hosts in mode.
+func NewMultiContext(mode HostMode, hosts ...string) *MultiContext {
+	c := &MultiContext{Mode: mode}
+	for _, h := range hosts {
+		c.Contexts = append(c.Contexts, Host(h))
+	}
+	return c
+}
+
+// Query performs the request against c's contexts. In Failover mode the
+// response of the first context to succeed is returned. In FanOut mode all
+// contexts are queried concurrently and their responses merged, keeping only
+// the first response for each metric and tagset; an error is returned only if
+// every context fails.
+func (c *MultiContext) Query(r *Request) (ResponseSet, error) {
+	if len(c.Contexts) == 0 {
+		return nil, fmt.Errorf("opentsdb: no hosts")
+	}
+	if c.Mode == Failover {
+		var err error
+		for _, ctx := range c.Contexts {
+			var tr ResponseSet
+			if tr, err = ctx.Query(r); err == nil {
+				return tr, nil
+			}
+		}
+		return nil, err
+	}
+	responses := make([]ResponseSet, len(c.Contexts))
+	errs := make([]error, len(c.Contexts))
+	var wg sync.WaitGroup
+	for i, ctx := range c.Contexts {
+		wg.Add(1)
+		go func(i int, ctx Context) {
+			defer wg.Done()
+			responses[i], errs[i] = ctx.Query(r)
+		}(i, ctx)
+	}
+	wg.Wait()
+	var merged ResponseSet
+	seen := make(map[string]bool)
+	ok := false
+	for i, tr := range responses {
+		if errs[i] != nil {
+			continue
+		}
+		ok = true
+		for _, resp := range tr {
+			key := resp.Metric + resp.Tags.String()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, resp)
+		}
+	}
+	if !ok {
+		return nil, errs[0]
+	}
+	return merged, nil
+}
+
+// IsRetryable reports whether err is a transient query error: a network
+// timeout or a 5xx response from the server.
+func IsRetryable(err error) bool {
+	switch err := err.(type) {
+	case *RequestError:
+		return err.Err.Code >= 500
+	case *StatusError:
+		return err.Code >= 500
+	case net.Error:
+		return err.Timeout() || err.Temporary()
+	}
+	return false
+}
+
+// RetryContext is a Context which retries queries failing with a retryable
+// error, waiting Backoff before the first retry and doubling the wait after
+// each further attempt.
+type RetryContext struct {
+	Context
+	// Retries is the maximum number of retries after the initial attempt.
+	Retries int
+	Backoff time.Duration
+	// Cancel, if non nil, aborts any pending retry when closed.
+	Cancel <-chan struct{}
+}
+
+// NewRetryContext returns a context wrapping c which retries transient
+// errors up to retries times.
+func NewRetryContext(c Context, retries int) *RetryContext {
+	return &RetryContext{
+		Context: c,
+		Retries: retries,
+		Backoff: 500 * time.Millisecond,
+	}
+}
+
+// Query performs the request, retrying on transient errors.
+func (c *RetryContext) Query(r *Request) (tr ResponseSet, err error) {
+	wait := c.Backoff
+	for i := 0; ; i++ {
+		tr, err = c.Context.Query(r)
+		if err == nil || i >= c.Retries || !IsRetryable(err) {
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.Cancel:
+			return nil, fmt.Errorf("opentsdb: query cancelled: %v", err)
+		}
+		wait *= 2
+	}
+}
+
+// Ping pings the wrapped context if it implements Pinger.
+func (c *RetryContext) Ping() error {
+	if p, ok := c.Context.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// Ping succeeds if any of c's contexts is reachable. Contexts that do not
+// implement Pinger are assumed to be reachable.
+func (c *MultiContext) Ping() error {
+	err := fmt.Errorf("opentsdb: no hosts")
+	for _, ctx := range c.Contexts {
+		p, ok := ctx.(Pinger)
+		if !ok {
+			return nil
+		}
+		if err = p.Ping(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -1,6 +1,15 @@
 package opentsdb
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestClean(t *testing.T) {
 	clean := "aoeSNVT152-./_"
@@ -173,3 +182,171 @@ func TestValidTags(t *testing.T) {
 		}
 	}
 }
+
+type fakeContext struct {
+	rs    ResponseSet
+	err   error
+	calls int
+}
+
+func (c *fakeContext) Query(r *Request) (ResponseSet, error) {
+	c.calls++
+	return c.rs, c.err
+}
+
+func TestMultiContext(t *testing.T) {
+	a := &Response{Metric: "m", Tags: TagSet{"host": "a"}}
+	b := &Response{Metric: "m", Tags: TagSet{"host": "b"}}
+	down := func() *fakeContext { return &fakeContext{err: errors.New("down")} }
+	tests := []struct {
+		mode     HostMode
+		contexts []*fakeContext
+		groups   []string
+		calls    []int
+		err      bool
+	}{
+		{Failover, []*fakeContext{down(), {rs: ResponseSet{a}}, {rs: ResponseSet{b}}}, []string{"{host=a}"}, []int{1, 1, 0}, false},
+		{Failover, []*fakeContext{{rs: ResponseSet{b}}, {rs: ResponseSet{a}}}, []string{"{host=b}"}, []int{1, 0}, false},
+		{Failover, []*fakeContext{down(), down()}, nil, []int{1, 1}, true},
+		{FanOut, []*fakeContext{down(), {rs: ResponseSet{a}}, {rs: ResponseSet{a, b}}}, []string{"{host=a}", "{host=b}"}, []int{1, 1, 1}, false},
+		{FanOut, []*fakeContext{down(), down()}, nil, []int{1, 1}, true},
+	}
+	for i, test := range tests {
+		c := &MultiContext{Mode: test.mode}
+		for _, fc := range test.contexts {
+			c.Contexts = append(c.Contexts, fc)
+		}
+		rs, err := c.Query(&Request{})
+		if test.err {
+			if err == nil {
+				t.Errorf("%d: expected error", i)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		var groups []string
+		for _, r := range rs {
+			groups = append(groups, r.Tags.String())
+		}
+		if !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("%d: got groups %v, expected %v", i, groups, test.groups)
+		}
+		for j, fc := range test.contexts {
+			if fc.calls != test.calls[j] {
+				t.Errorf("%d: context %d: got %d calls, expected %d", i, j, fc.calls, test.calls[j])
+			}
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/version" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	upHost := strings.TrimPrefix(up.URL, "http://")
+	downHost := strings.TrimPrefix(down.URL, "http://")
+	tests := []struct {
+		p   Pinger
+		err bool
+	}{
+		{Host(upHost), false},
+		{Host(downHost), true},
+		{NewLimitContext(upHost, 1), false},
+		{NewLimitContext(downHost, 1), true},
+		{NewMultiContext(Failover, downHost, upHost), false},
+		{NewMultiContext(FanOut, downHost, downHost), true},
+	}
+	for i, test := range tests {
+		err := test.p.Ping()
+		if test.err && err == nil {
+			t.Errorf("%d: expected error", i)
+		} else if !test.err && err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+}
+
+// flakyContext fails with each of errs in turn before succeeding.
+type flakyContext struct {
+	errs  []error
+	calls int
+}
+
+func (c *flakyContext) Query(r *Request) (ResponseSet, error) {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return nil, c.errs[c.calls-1]
+	}
+	return ResponseSet{}, nil
+}
+
+func TestRetryContext(t *testing.T) {
+	unavailable := &StatusError{Code: http.StatusServiceUnavailable, Msg: "unavailable"}
+	badRequest := &RequestError{}
+	badRequest.Err.Code = http.StatusBadRequest
+	tests := []struct {
+		errs    []error
+		retries int
+		calls   int
+		err     bool
+	}{
+		{[]error{unavailable, unavailable}, 3, 3, false},
+		{[]error{unavailable, unavailable}, 1, 2, true},
+		{[]error{badRequest}, 3, 1, true},
+		{[]error{errors.New("parse error")}, 3, 1, true},
+	}
+	for i, test := range tests {
+		fc := &flakyContext{errs: test.errs}
+		c := &RetryContext{Context: fc, Retries: test.retries, Backoff: time.Millisecond}
+		_, err := c.Query(&Request{})
+		if test.err && err == nil {
+			t.Errorf("%d: expected error", i)
+		} else if !test.err && err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+		if fc.calls != test.calls {
+			t.Errorf("%d: got %d calls, expected %d", i, fc.calls, test.calls)
+		}
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	fc := &flakyContext{errs: []error{unavailable}}
+	c := &RetryContext{Context: fc, Retries: 3, Backoff: time.Hour, Cancel: cancel}
+	if _, err := c.Query(&Request{}); err == nil {
+		t.Error("expected error after cancel")
+	}
+	if fc.calls != 1 {
+		t.Errorf("got %d calls after cancel, expected 1", fc.calls)
+	}
+}
+
+func TestDuplicateTimestamps(t *testing.T) {
+	body := `[{"metric":"m","tags":{},"dps":{"60":1,"120":2,"60":5,"60":6}}]`
+	var rs ResponseSet
+	if err := json.Unmarshal([]byte(body), &rs); err != nil {
+		t.Fatal(err)
+	}
+	expected := DPS{"60": 4, "120": 2}
+	if got := rs[0].DPS; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	for _, body := range []string{`null`, `[1]`, `{"60":"x"}`} {
+		var d DPS
+		err := json.Unmarshal([]byte(body), &d)
+		if body == `null` {
+			if err != nil || d != nil {
+				t.Errorf("%s: got %v, %v", body, d, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected error", body)
+		}
+	}
+}